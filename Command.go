@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 命令行子命令定义
+const (
+	SubcommandServe    = "serve"
+	SubcommandDownload = "download"
+	SubcommandEstimate = "estimate"
+	SubcommandRetry    = "retry"
+)
+
+// 命令行退出码定义
+const (
+	ExitOK = 0
+	// ExitError 参数错误或任务无法开始
+	ExitError = 1
+	// ExitFailedTiles 任务已结束，但仍有文件下载失败
+	ExitFailedTiles = 2
+	// ExitCancelled 被Ctrl+C中断，可通过retry继续
+	ExitCancelled = 130
+)
+
+// 命令行模式下默认最多下载的轮数，避免网络不通时一直重试
+const defaultMaxRounds = 10
+
+const commandUsage = `用法：
+  GetMapsService [serve] [--port 8000]
+  GetMapsService download [区域参数] [--out 任务目录] [--storage file|mbtiles] [--dedupe] [--empty-tiles store|skip|dedupe|error] [--max-rounds 10]
+  GetMapsService estimate [区域参数] [--json]
+  GetMapsService retry [--max-rounds 10] <任务目录>
+
+区域参数：
+  --provinces 北京,天津  --min-zoom 3  --max-zoom 15  --provider baidu
+  --longitude 115.7,117.4  --latitude 39.4,41.6  --geojson area.geojson  --datum wgs84|gcj02|bd09
+`
+
+// ConsoleReporter 定义
+// 命令行模式下代替WebSocket，在事件说明前加上时间和任务编号输出到控制台。
+type ConsoleReporter struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+// NewConsoleReporter 定义
+func NewConsoleReporter(writer io.Writer) *ConsoleReporter {
+	return &ConsoleReporter{writer: writer}
+}
+
+// Report 定义
+func (reporter *ConsoleReporter) Report(event *JobEvent) {
+	message := strings.TrimRight(eventText(event), "\n")
+	if message == "" {
+		return
+	}
+	if event.JobID > 0 {
+		message = fmt.Sprintf("[任务%d] %s", event.JobID, message)
+	}
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	fmt.Fprintf(reporter.writer, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), message)
+}
+
+// areaFlags 定义
+// download和estimate共用的参数，转换为与网页提交相同的JSON后由analysePara解析。
+type areaFlags struct {
+	provinces, provider, longitude, latitude, geoJSONFile, datum *string
+	minZoom, maxZoom                                             *int
+}
+
+// newAreaFlags 定义
+func newAreaFlags(flags *flag.FlagSet) *areaFlags {
+	return &areaFlags{
+		provinces:   flags.String("provinces", "", "要下载的省份，逗号分隔"),
+		provider:    flags.String("provider", "", "地图源，默认为"+DefaultTileProviderName+"；下载到已有的任务目录时沿用该任务的地图源"),
+		longitude:   flags.String("longitude", "", "自定义区域的经度范围，例如115.7,117.4"),
+		latitude:    flags.String("latitude", "", "自定义区域的纬度范围，例如39.4,41.6"),
+		geoJSONFile: flags.String("geojson", "", "GeoJSON区域文件"),
+		datum:       flags.String("datum", "", "自定义区域的坐标系：wgs84、gcj02或bd09"),
+		minZoom:     flags.Int("min-zoom", 3, "最小层级"),
+		maxZoom:     flags.Int("max-zoom", 19, "最大层级"),
+	}
+}
+
+// message 定义
+func (area *areaFlags) message(extra map[string]interface{}) ([]byte, error) {
+	dat := map[string]interface{}{
+		"MinZoomLevel": *area.minZoom,
+		"MaxZoomLevel": *area.maxZoom,
+		"Province":     *area.provinces,
+		"Provider":     *area.provider,
+		"Longitude":    *area.longitude,
+		"Latitude":     *area.latitude,
+		"Datum":        *area.datum,
+	}
+	if *area.geoJSONFile != "" {
+		data, err := ioutil.ReadFile(*area.geoJSONFile)
+		if err != nil {
+			return nil, err
+		}
+		dat["GeoJSON"] = string(data)
+	}
+	for key, value := range extra {
+		dat[key] = value
+	}
+	return json.Marshal(dat)
+}
+
+// RunCommand 定义
+// 没有子命令时启动网页服务，与之前的行为相同。
+func RunCommand(config *ConfigStruct, args []string) int {
+	command := SubcommandServe
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case SubcommandServe:
+		return runServe(config, args)
+	case SubcommandDownload:
+		return runDownload(config, args)
+	case SubcommandEstimate:
+		return runEstimate(config, args)
+	case SubcommandRetry:
+		return runRetry(config, args)
+	case "help":
+		fmt.Print(commandUsage)
+		return ExitOK
+	}
+	fmt.Fprintf(os.Stderr, "未知的子命令%s\n%s", command, commandUsage)
+	return ExitError
+}
+
+// newFlagSet 定义
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, commandUsage)
+	}
+	return flags
+}
+
+// runServe 定义
+func runServe(config *ConfigStruct, args []string) int {
+	flags := newFlagSet(SubcommandServe)
+	port := flags.Int("port", config.Port, "网页服务端口")
+	if flags.Parse(args) != nil {
+		return ExitError
+	}
+
+	webSocketService := NewWebSocketService("web", "home.html", *port)
+	jobManager := NewJobManager(config, webSocketService.PublishEvent)
+	// 网页和接口只能使用工作目录下的任务目录
+	jobRoot, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	jobManager.jobRoot = jobRoot
+	webSocketService.requestCallback = jobManager.HandleRequest
+	webSocketService.estimateCallback = jobManager.EstimateJSON
+	webSocketService.tileServer = NewTileServer(config, "web", "preview.html")
+	webSocketService.tileServer.jobActive = jobManager.JobPathActive
+	jobManager.evictCallback = webSocketService.events.Remove
+	webSocketService.jobAPI = NewJobAPI(jobManager, webSocketService.events)
+	webSocketService.metrics = jobManager.metrics
+
+	webSocketService.Start()
+	return ExitOK
+}
+
+// runDownload 定义
+func runDownload(config *ConfigStruct, args []string) int {
+	flags := newFlagSet(SubcommandDownload)
+	area := newAreaFlags(flags)
+	out := flags.String("out", "", "任务目录，不存在时自动创建，已存在时跳过其中已下载的文件；留空时在当前目录新建map目录")
+	storage := flags.String("storage", "", "保存方式：file或mbtiles，默认为file；下载到已有的任务目录时沿用该任务的保存方式")
+	dedupe := flags.Bool("dedupe", false, "按内容去重保存")
+	emptyTiles := flags.String("empty-tiles", "", "空白和占位瓦片的处理方式：store、skip、dedupe或error")
+	maxRounds := flags.Int("max-rounds", defaultMaxRounds, "最多下载的轮数，0为不限")
+	if flags.Parse(args) != nil {
+		return ExitError
+	}
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0777); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return ExitError
+		}
+	}
+	message, err := area.message(map[string]interface{}{
+		"JobPath":         *out,
+		"Storage":         *storage,
+		"Dedupe":          *dedupe,
+		"EmptyTilePolicy": *emptyTiles,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+
+	reporter := NewConsoleReporter(os.Stdout)
+	manager := NewJobManager(config, reporter.Report)
+	para, err := manager.analysePara(message)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	downloader := manager.newDownloader(reporter.Report)
+	downloader.maxDownloadTimes = *maxRounds
+	return runDownloader(downloader, func() error { return downloader.Download(para) })
+}
+
+// runEstimate 定义
+func runEstimate(config *ConfigStruct, args []string) int {
+	flags := newFlagSet(SubcommandEstimate)
+	area := newAreaFlags(flags)
+	jsonOutput := flags.Bool("json", false, "以JSON格式输出")
+	if flags.Parse(args) != nil {
+		return ExitError
+	}
+	message, err := area.message(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	manager := NewJobManager(config, nil)
+	estimate, err := manager.Estimate(message)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		encoder.Encode(estimate)
+	} else {
+		fmt.Print(estimate.String())
+	}
+	return ExitOK
+}
+
+// runRetry 定义
+func runRetry(config *ConfigStruct, args []string) int {
+	flags := newFlagSet(SubcommandRetry)
+	maxRounds := flags.Int("max-rounds", defaultMaxRounds, "最多下载的轮数，0为不限")
+	if flags.Parse(args) != nil {
+		return ExitError
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return ExitError
+	}
+	jobPath := flags.Arg(0)
+	if err := checkJobPath(jobPath); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	reporter := NewConsoleReporter(os.Stdout)
+	manager := NewJobManager(config, reporter.Report)
+	downloader := manager.newDownloader(reporter.Report)
+	downloader.maxDownloadTimes = *maxRounds
+	return runDownloader(downloader, func() error { return downloader.RetryJob(jobPath) })
+}
+
+// runDownloader 定义
+// 按Ctrl+C时取消下载并保存断点，再按一次直接退出。
+func runDownloader(downloader *GetBaiduMap, run func() error) int {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		if _, ok := <-interrupt; !ok {
+			return
+		}
+		downloader.Cancel()
+		<-interrupt
+		os.Exit(ExitCancelled)
+	}()
+
+	err := run()
+	switch {
+	case err == errJobCancelled:
+		return ExitCancelled
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err.Error())
+		return ExitError
+	}
+	if _, _, _, errorCounter := downloader.Progress(); errorCounter > 0 {
+		return ExitFailedTiles
+	}
+	return ExitOK
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// 两次减半之间的最短间隔，避免同一波失败的请求把并发数连续减半
+	concurrencyDecreaseCooldown = 2 * time.Second
+	retryBaseDelay              = 200 * time.Millisecond
+	retryMaxDelay               = 10 * time.Second
+)
+
+// ConcurrencyController 定义
+// 按AIMD调整同时下载的瓦片数：每成功limit个瓦片并发数加1，
+// 遇到限流（403、429、5xx）、超时或无效瓦片时并发数减半，范围为[minLimit, maxLimit]。
+type ConcurrencyController struct {
+	mu           sync.Mutex
+	limit        float64
+	minLimit     float64
+	maxLimit     float64
+	inUse        int
+	notify       chan struct{}
+	lastDecrease time.Time
+}
+
+// NewConcurrencyController 定义
+func NewConcurrencyController(minLimit int, maxLimit int) *ConcurrencyController {
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	if minLimit < 1 || minLimit > maxLimit {
+		minLimit = 1
+	}
+	controller := new(ConcurrencyController)
+	controller.minLimit = float64(minLimit)
+	controller.maxLimit = float64(maxLimit)
+	controller.limit = math.Max(controller.minLimit, math.Floor(controller.maxLimit/4))
+	controller.notify = make(chan struct{})
+	return controller
+}
+
+// broadcast 定义
+// 调用者需持有controller.mu。
+func (controller *ConcurrencyController) broadcast() {
+	close(controller.notify)
+	controller.notify = make(chan struct{})
+}
+
+// Acquire 定义
+func (controller *ConcurrencyController) Acquire(ctx context.Context) bool {
+	for {
+		controller.mu.Lock()
+		if controller.inUse < int(controller.limit) {
+			controller.inUse++
+			controller.mu.Unlock()
+			return true
+		}
+		notify := controller.notify
+		controller.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Release 定义
+func (controller *ConcurrencyController) Release() {
+	controller.mu.Lock()
+	controller.inUse--
+	controller.broadcast()
+	controller.mu.Unlock()
+}
+
+// Success 定义
+func (controller *ConcurrencyController) Success() {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	old := int(controller.limit)
+	controller.limit = math.Min(controller.maxLimit, controller.limit+1/controller.limit)
+	if int(controller.limit) > old {
+		controller.broadcast()
+	}
+}
+
+// Throttled 定义
+func (controller *ConcurrencyController) Throttled() {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	if time.Since(controller.lastDecrease) < concurrencyDecreaseCooldown {
+		return
+	}
+	controller.lastDecrease = time.Now()
+	controller.limit = math.Max(controller.minLimit, math.Floor(controller.limit/2))
+}
+
+// Limit 定义
+func (controller *ConcurrencyController) Limit() int {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	return int(controller.limit)
+}
+
+// retryDelay 定义
+// 第attempt次重试前的等待时间：指数增长，并在[d/2, d)之间随机抖动。
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// sleepContext 定义
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
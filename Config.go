@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 )
 
 // ConfigJSONStruct 定义
@@ -12,8 +13,15 @@ type ConfigJSONStruct struct {
 	UpdateDate               string
 	Port                     int
 	AllowedThreadCount       int
+	MinThreadCount           int
 	ProcessListCapacity      int
 	ProcessErrorListCapacity int
+	MaxRunningJobs           int
+	TileProviders            []TileProviderConfigStruct
+	HTTPClient               *HTTPClientConfigStruct
+	RateLimit                RateLimitConfigStruct
+	TileValidation           TileValidationConfigStruct
+	DefaultDatum             string
 	ProvinceInformation      []map[string]interface{}
 }
 
@@ -23,8 +31,17 @@ type ConfigStruct struct {
 	UpdateDate               string
 	Port                     int
 	AllowedThreadCount       int
+	MinThreadCount           int
 	ProcessListCapacity      int
 	ProcessErrorListCapacity int
+	MaxRunningJobs           int
+	TileProviders            map[string]TileProvider
+	DefaultHTTPClient        *TileHTTPClient
+	HTTPClients              map[string]*TileHTTPClient
+	RateLimit                RateLimitConfigStruct
+	EmptyTilePolicy          string
+	TileValidator            *TileValidator
+	DefaultDatum             string
 	ProvinceInformation      []ProvinceInfoStruct
 }
 
@@ -38,6 +55,8 @@ type ProvinceInfoStruct struct {
 type AreaStruct struct {
 	longitude [2]float64
 	latitude  [2]float64
+	datum     string
+	polygons  []PolygonStruct
 }
 
 // NewConfig 定义
@@ -53,8 +72,57 @@ func NewConfig() *ConfigStruct {
 	config.UpdateDate = jsonStruct.UpdateDate
 	config.Port = jsonStruct.Port
 	config.AllowedThreadCount = jsonStruct.AllowedThreadCount
+	config.MinThreadCount = jsonStruct.MinThreadCount
 	config.ProcessListCapacity = jsonStruct.ProcessListCapacity
 	config.ProcessErrorListCapacity = jsonStruct.ProcessErrorListCapacity
+	config.MaxRunningJobs = jsonStruct.MaxRunningJobs
+	config.RateLimit = jsonStruct.RateLimit
+
+	// 任务未指定时空白和占位瓦片的处理方式，默认与普通瓦片一样保存
+	config.EmptyTilePolicy = jsonStruct.TileValidation.EmptyTilePolicy
+	if config.EmptyTilePolicy == "" {
+		config.EmptyTilePolicy = EmptyTileStore
+	}
+	if !validEmptyTilePolicy(config.EmptyTilePolicy) {
+		fmt.Println("unknown empty tile policy", config.EmptyTilePolicy)
+		return nil
+	}
+	config.TileValidator, err = NewTileValidator(jsonStruct.TileValidation.PlaceholderHashes, jsonStruct.TileValidation.PlaceholderThreshold)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+
+	// 所有地图源共用HTTPClient中的配置，地图源可以在自己的HTTPClient中覆盖
+	httpClientConfig := defaultHTTPClientConfig.merge(jsonStruct.HTTPClient)
+	config.DefaultHTTPClient, err = NewTileHTTPClient(httpClientConfig)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+	config.HTTPClients = make(map[string]*TileHTTPClient)
+
+	config.TileProviders = make(map[string]TileProvider)
+	config.TileProviders[DefaultTileProviderName] = NewBaiduTileProvider()
+	for _, value := range jsonStruct.TileProviders {
+		// 只有Name为baidu且没有URLTemplate的配置用于设置内置百度地图源的HTTPClient
+		if value.Name != DefaultTileProviderName || value.URLTemplate != "" {
+			provider, err := NewTemplateTileProvider(value)
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			config.TileProviders[provider.Name()] = provider
+		}
+		if value.HTTPClient != nil {
+			httpClient, err := NewTileHTTPClient(httpClientConfig.merge(value.HTTPClient))
+			if err != nil {
+				fmt.Println(value.Name, err.Error())
+				continue
+			}
+			config.HTTPClients[value.Name] = httpClient
+		}
+	}
 
 	// if runtime.GOOS == "darwin" {
 	// }
@@ -62,13 +130,39 @@ func NewConfig() *ConfigStruct {
 	// 	config.AllowedThreadCount = 100
 	// }
 
+	// 未声明坐标系的区域使用DefaultDatum，DefaultDatum为空时按BD-09处理
+	config.DefaultDatum, err = normalizeDatum(jsonStruct.DefaultDatum)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+	if config.DefaultDatum == "" {
+		config.DefaultDatum = DatumBD09
+	}
+
 	config.ProvinceInformation = make([]ProvinceInfoStruct, 0, 50)
 	for _, value := range jsonStruct.ProvinceInformation {
 		var p ProvinceInfoStruct
 		p.province = value["province"].(string)
-		longitudeInterface := value["area"].(map[string]interface{})["longitude"].([]interface{})
-		latitudeInterface := value["area"].(map[string]interface{})["latitude"].([]interface{})
-		p.area = AreaStruct{[2]float64{longitudeInterface[0].(float64), longitudeInterface[1].(float64)}, [2]float64{latitudeInterface[0].(float64), latitudeInterface[1].(float64)}}
+		areaInterface := value["area"].(map[string]interface{})
+		longitudeInterface := areaInterface["longitude"].([]interface{})
+		latitudeInterface := areaInterface["latitude"].([]interface{})
+		datum, _ := areaInterface["datum"].(string)
+		datum, err = normalizeDatum(datum)
+		if err != nil {
+			fmt.Println(p.province, err.Error())
+			continue
+		}
+		if datum == "" {
+			datum = config.DefaultDatum
+		}
+		p.area = AreaStruct{[2]float64{longitudeInterface[0].(float64), longitudeInterface[1].(float64)}, [2]float64{latitudeInterface[0].(float64), latitudeInterface[1].(float64)}, datum, nil}
+		if areaInterface["geojson"] != nil {
+			p.area.polygons, err = loadGeoJSON(areaInterface["geojson"])
+			if err != nil {
+				fmt.Println(p.province, err.Error())
+			}
+		}
 		config.ProvinceInformation = append(config.ProvinceInformation, p)
 	}
 	fmt.Println("当前配置文件信息为：")
@@ -76,6 +170,43 @@ func NewConfig() *ConfigStruct {
 	return config
 }
 
+// TileProvider 定义
+func (config *ConfigStruct) TileProvider(name string) (TileProvider, error) {
+	if name == "" {
+		name = DefaultTileProviderName
+	}
+	provider, ok := config.TileProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tile provider %s", name)
+	}
+	return provider, nil
+}
+
+// HTTPClient 定义
+func (config *ConfigStruct) HTTPClient(providerName string) *TileHTTPClient {
+	if httpClient, ok := config.HTTPClients[providerName]; ok {
+		return httpClient
+	}
+	return config.DefaultHTTPClient
+}
+
+// loadGeoJSON 定义
+// geojson可以是config目录下的文件名，也可以直接写GeoJSON对象。
+func loadGeoJSON(value interface{}) (polygons []PolygonStruct, err error) {
+	var data []byte
+	switch geoJSON := value.(type) {
+	case string:
+		data, err = ioutil.ReadFile(filepath.Join("config", geoJSON))
+	default:
+		data, err = json.Marshal(geoJSON)
+	}
+	if err != nil {
+		return
+	}
+	polygons, err = ParseGeoJSON(data)
+	return
+}
+
 // loadJSONFile 定义
 func (config *ConfigStruct) loadJSONFile(jsonStruct *ConfigJSONStruct) (err error) {
 	var jsonStr []byte
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// 坐标系定义
+const (
+	DatumWGS84 = "wgs84"
+	DatumGCJ02 = "gcj02"
+	DatumBD09  = "bd09"
+)
+
+const (
+	krasovskyA  = 6378245.0
+	krasovskyEE = 0.00669342162296594323
+	bd09XPi     = math.Pi * 3000.0 / 180.0
+)
+
+// normalizeDatum 定义
+func normalizeDatum(datum string) (string, error) {
+	datum = strings.ToLower(strings.Replace(strings.Replace(datum, "-", "", -1), "_", "", -1))
+	switch datum {
+	case DatumWGS84, DatumGCJ02, DatumBD09:
+		return datum, nil
+	case "":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown datum %s", datum)
+}
+
+// ConvertDatum 定义
+// 在WGS84、GCJ-02、BD-09之间转换经纬度，WGS84与BD-09之间经由GCJ-02转换。
+func ConvertDatum(lng float64, lat float64, from string, to string) (float64, float64) {
+	if from == to {
+		return lng, lat
+	}
+	switch from {
+	case DatumWGS84:
+		lng, lat = WGS84ToGCJ02(lng, lat)
+	case DatumBD09:
+		lng, lat = BD09ToGCJ02(lng, lat)
+	}
+	switch to {
+	case DatumWGS84:
+		lng, lat = GCJ02ToWGS84(lng, lat)
+	case DatumBD09:
+		lng, lat = GCJ02ToBD09(lng, lat)
+	}
+	return lng, lat
+}
+
+// outOfChina 定义
+func outOfChina(lng float64, lat float64) bool {
+	return lng < 72.004 || lng > 137.8347 || lat < 0.8293 || lat > 55.8271
+}
+
+// gcj02Offset 定义
+func gcj02Offset(lng float64, lat float64) (dLng float64, dLat float64) {
+	x := lng - 105.0
+	y := lat - 35.0
+	dLat = -100.0 + 2.0*x + 3.0*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x))
+	dLat += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	dLat += (20.0*math.Sin(y*math.Pi) + 40.0*math.Sin(y/3.0*math.Pi)) * 2.0 / 3.0
+	dLat += (160.0*math.Sin(y/12.0*math.Pi) + 320*math.Sin(y*math.Pi/30.0)) * 2.0 / 3.0
+	dLng = 300.0 + x + 2.0*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x))
+	dLng += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	dLng += (20.0*math.Sin(x*math.Pi) + 40.0*math.Sin(x/3.0*math.Pi)) * 2.0 / 3.0
+	dLng += (150.0*math.Sin(x/12.0*math.Pi) + 300.0*math.Sin(x/30.0*math.Pi)) * 2.0 / 3.0
+
+	radLat := lat / 180.0 * math.Pi
+	magic := math.Sin(radLat)
+	magic = 1 - krasovskyEE*magic*magic
+	sqrtMagic := math.Sqrt(magic)
+	dLat = (dLat * 180.0) / ((krasovskyA * (1 - krasovskyEE)) / (magic * sqrtMagic) * math.Pi)
+	dLng = (dLng * 180.0) / (krasovskyA / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return
+}
+
+// WGS84ToGCJ02 定义
+func WGS84ToGCJ02(lng float64, lat float64) (float64, float64) {
+	if outOfChina(lng, lat) {
+		return lng, lat
+	}
+	dLng, dLat := gcj02Offset(lng, lat)
+	return lng + dLng, lat + dLat
+}
+
+// GCJ02ToWGS84 定义
+// 迭代求逆，误差小于1e-7度。
+func GCJ02ToWGS84(lng float64, lat float64) (float64, float64) {
+	if outOfChina(lng, lat) {
+		return lng, lat
+	}
+	wgsLng, wgsLat := lng, lat
+	for i := 0; i < 10; i++ {
+		gcjLng, gcjLat := WGS84ToGCJ02(wgsLng, wgsLat)
+		dLng := gcjLng - lng
+		dLat := gcjLat - lat
+		wgsLng -= dLng
+		wgsLat -= dLat
+		if math.Abs(dLng) < 1e-7 && math.Abs(dLat) < 1e-7 {
+			break
+		}
+	}
+	return wgsLng, wgsLat
+}
+
+// GCJ02ToBD09 定义
+func GCJ02ToBD09(lng float64, lat float64) (float64, float64) {
+	z := math.Sqrt(lng*lng+lat*lat) + 0.00002*math.Sin(lat*bd09XPi)
+	theta := math.Atan2(lat, lng) + 0.000003*math.Cos(lng*bd09XPi)
+	return z*math.Cos(theta) + 0.0065, z*math.Sin(theta) + 0.006
+}
+
+// BD09ToGCJ02 定义
+func BD09ToGCJ02(lng float64, lat float64) (float64, float64) {
+	x := lng - 0.0065
+	y := lat - 0.006
+	z := math.Sqrt(x*x+y*y) - 0.00002*math.Sin(y*bd09XPi)
+	theta := math.Atan2(y, x) - 0.000003*math.Cos(x*bd09XPi)
+	return z * math.Cos(theta), z * math.Sin(theta)
+}
+
+// convertRectArea 定义
+// 转换矩形的四个角点，取外接矩形。
+func convertRectArea(rect RectAreaStruct, from string, to string) RectAreaStruct {
+	if from == to {
+		return rect
+	}
+	corners := [][2]float64{
+		{rect.left, rect.top}, {rect.left, rect.bottom}, {rect.right, rect.top}, {rect.right, rect.bottom},
+	}
+	result := RectAreaStruct{math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)}
+	for _, corner := range corners {
+		lng, lat := ConvertDatum(corner[0], corner[1], from, to)
+		result.left = math.Min(result.left, lng)
+		result.right = math.Max(result.right, lng)
+		result.top = math.Min(result.top, lat)
+		result.bottom = math.Max(result.bottom, lat)
+	}
+	return result
+}
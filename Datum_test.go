@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestDatumReference 定义
+// 参考值取自常用的coordtransform库对天安门116.404,39.915的转换结果。
+func TestDatumReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		convert  func(float64, float64) (float64, float64)
+		lng, lat float64
+	}{
+		{"WGS84转GCJ-02", WGS84ToGCJ02, 116.41024449916938, 39.91640428150164},
+		{"GCJ-02转BD-09", GCJ02ToBD09, 116.41036949371029, 39.92133699351021},
+		{"BD-09转GCJ-02", BD09ToGCJ02, 116.39762729119315, 39.90865673957631},
+	}
+	for _, test := range tests {
+		lng, lat := test.convert(116.404, 39.915)
+		if math.Abs(lng-test.lng) > 1e-9 || math.Abs(lat-test.lat) > 1e-9 {
+			t.Errorf("%s：结果为%.12f,%.12f，应为%.12f,%.12f", test.name, lng, lat, test.lng, test.lat)
+		}
+	}
+}
+
+// TestDatumRoundTrip 定义
+// GCJ-02转WGS84迭代求逆，误差小于1e-7度；BD-09的正反算法本身不严格互逆，误差约为1e-6度。
+func TestDatumRoundTrip(t *testing.T) {
+	tests := []struct {
+		from, to  string
+		tolerance float64
+	}{
+		{DatumWGS84, DatumGCJ02, 1e-7},
+		{DatumGCJ02, DatumBD09, 1e-5},
+		{DatumWGS84, DatumBD09, 1e-5},
+	}
+	for _, test := range tests {
+		for _, point := range projectionPoints {
+			lng, lat := ConvertDatum(point.lng, point.lat, test.from, test.to)
+			lng, lat = ConvertDatum(lng, lat, test.to, test.from)
+			if math.Abs(lng-point.lng) > test.tolerance || math.Abs(lat-point.lat) > test.tolerance {
+				t.Errorf("%s：%s转%s后转回%f,%f", point.name, test.from, test.to, lng, lat)
+			}
+		}
+	}
+}
+
+// TestDatumOffset 定义
+// 国内WGS84与GCJ-02之间的偏移为数百米，BD-09在GCJ-02基础上再偏移约1千米。
+func TestDatumOffset(t *testing.T) {
+	for _, point := range projectionPoints {
+		gcjLng, gcjLat := WGS84ToGCJ02(point.lng, point.lat)
+		if offset := math.Hypot(gcjLng-point.lng, gcjLat-point.lat); offset < 0.001 || offset > 0.01 {
+			t.Errorf("%s：WGS84转GCJ-02的偏移为%f度", point.name, offset)
+		}
+		bdLng, bdLat := GCJ02ToBD09(gcjLng, gcjLat)
+		if offset := math.Hypot(bdLng-gcjLng, bdLat-gcjLat); offset < 0.005 || offset > 0.015 {
+			t.Errorf("%s：GCJ-02转BD-09的偏移为%f度", point.name, offset)
+		}
+	}
+}
+
+// TestDatumOutOfChina 定义
+// 国外的坐标在WGS84与GCJ-02之间不做偏移。
+func TestDatumOutOfChina(t *testing.T) {
+	points := []struct {
+		name     string
+		lng, lat float64
+	}{
+		{"东京", 139.69, 35.69},
+		{"伦敦", -0.1276, 51.5072},
+		{"悉尼", 151.21, -33.87},
+		{"莫斯科", 37.62, 55.75},
+	}
+	for _, point := range points {
+		for _, convert := range []func(float64, float64) (float64, float64){WGS84ToGCJ02, GCJ02ToWGS84} {
+			lng, lat := convert(point.lng, point.lat)
+			if lng != point.lng || lat != point.lat {
+				t.Errorf("%s：%f,%f被转换为%f,%f", point.name, point.lng, point.lat, lng, lat)
+			}
+		}
+	}
+}
+
+// TestNormalizeDatum 定义
+func TestNormalizeDatum(t *testing.T) {
+	tests := map[string]string{"WGS84": DatumWGS84, "GCJ-02": DatumGCJ02, "bd_09": DatumBD09, "": ""}
+	for input, expected := range tests {
+		datum, err := normalizeDatum(input)
+		if err != nil || datum != expected {
+			t.Errorf("%s：结果为%s，%v", input, datum, err)
+		}
+	}
+	if _, err := normalizeDatum("cgcs2000"); err == nil {
+		t.Errorf("未知坐标系应返回错误")
+	}
+}
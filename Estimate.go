@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	throughputWindow        = 60
+	defaultEstimateTileSize = 20480
+)
+
+// tileSizeSample 定义
+type tileSizeSample struct {
+	count uint64
+	bytes uint64
+}
+
+// TileStatistics 定义
+// 记录已下载瓦片的平均大小（按地图源和层级）和最近一分钟的下载速度，供预估使用。
+type TileStatistics struct {
+	mu         sync.Mutex
+	sizes      map[string]*tileSizeSample
+	buckets    [throughputWindow]uint64
+	bucketTime [throughputWindow]int64
+}
+
+// NewTileStatistics 定义
+func NewTileStatistics() *TileStatistics {
+	statistics := new(TileStatistics)
+	statistics.sizes = make(map[string]*tileSizeSample)
+	return statistics
+}
+
+// RecordTile 定义
+func (statistics *TileStatistics) RecordTile(provider string, zoomLevel int, size int) {
+	statistics.mu.Lock()
+	defer statistics.mu.Unlock()
+	for _, key := range []string{fmt.Sprintf("%s/%d", provider, zoomLevel), provider} {
+		sample, ok := statistics.sizes[key]
+		if !ok {
+			sample = new(tileSizeSample)
+			statistics.sizes[key] = sample
+		}
+		sample.count++
+		sample.bytes += uint64(size)
+	}
+
+	now := time.Now().Unix()
+	index := now % throughputWindow
+	if statistics.bucketTime[index] != now {
+		statistics.bucketTime[index] = now
+		statistics.buckets[index] = 0
+	}
+	statistics.buckets[index]++
+}
+
+// AverageSize 定义
+// 优先使用同层级的样本，没有时使用该地图源所有层级的平均值。
+func (statistics *TileStatistics) AverageSize(provider string, zoomLevel int) (float64, bool) {
+	statistics.mu.Lock()
+	defer statistics.mu.Unlock()
+	for _, key := range []string{fmt.Sprintf("%s/%d", provider, zoomLevel), provider} {
+		if sample, ok := statistics.sizes[key]; ok && sample.count > 0 {
+			return float64(sample.bytes) / float64(sample.count), true
+		}
+	}
+	return 0, false
+}
+
+// Throughput 定义
+// 返回最近一分钟内平均每秒下载成功的瓦片数。
+func (statistics *TileStatistics) Throughput() float64 {
+	statistics.mu.Lock()
+	defer statistics.mu.Unlock()
+	now := time.Now().Unix()
+	var counter uint64
+	for index := range statistics.buckets {
+		if now-statistics.bucketTime[index] < throughputWindow {
+			counter += statistics.buckets[index]
+		}
+	}
+	return float64(counter) / throughputWindow
+}
+
+// ZoomEstimateStruct 定义
+type ZoomEstimateStruct struct {
+	ZoomLevel       int
+	Tiles           uint64
+	AverageTileSize float64
+	Bytes           uint64
+}
+
+// EstimateStruct 定义
+type EstimateStruct struct {
+	Provider       string
+	Provinces      string
+	Zooms          []ZoomEstimateStruct
+	Total          uint64
+	Bytes          uint64
+	SizeSampled    bool
+	TilesPerSecond float64
+	Seconds        float64
+}
+
+// countTiles 定义
+func (instance *GetBaiduMap) countTiles(minZoom int, maxZoom int, polygons []PolygonStruct) []uint64 {
+	counters := make([]uint64, 0, maxZoom-minZoom+1)
+	for zoomCounter := minZoom; zoomCounter <= maxZoom; zoomCounter++ {
+		counters = append(counters, CountPolygonTiles(instance.provider.Scheme(), zoomCounter, polygons))
+	}
+	return counters
+}
+
+// Estimate 定义
+// 只枚举瓦片不下载，根据已下载瓦片的大小和最近的下载速度估算磁盘占用和耗时。
+func (instance *GetBaiduMap) Estimate(para *DownloadParaStruct) (estimate EstimateStruct, err error) {
+	err = instance.setProvider(para.provider)
+	if err != nil {
+		return
+	}
+	polygons := instance.getDownloadingAreas(para)
+	counters := instance.countTiles(para.minZoomLevel, para.maxZoomLevel, polygons)
+
+	estimate.Provider = instance.provider.Name()
+	estimate.Provinces = para.provinces
+	estimate.SizeSampled = true
+	for index, counter := range counters {
+		zoomLevel := para.minZoomLevel + index
+		averageSize := float64(defaultEstimateTileSize)
+		if instance.statistics != nil {
+			if size, ok := instance.statistics.AverageSize(estimate.Provider, zoomLevel); ok {
+				averageSize = size
+			} else {
+				estimate.SizeSampled = false
+			}
+		} else {
+			estimate.SizeSampled = false
+		}
+		zoom := ZoomEstimateStruct{zoomLevel, counter, averageSize, uint64(averageSize * float64(counter))}
+		estimate.Zooms = append(estimate.Zooms, zoom)
+		estimate.Total += zoom.Tiles
+		estimate.Bytes += zoom.Bytes
+	}
+	if instance.statistics != nil {
+		estimate.TilesPerSecond = instance.statistics.Throughput()
+	}
+	if estimate.TilesPerSecond > 0 {
+		estimate.Seconds = float64(estimate.Total) / estimate.TilesPerSecond
+	}
+	return
+}
+
+// String 定义
+func (estimate *EstimateStruct) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("预估（%s，%s）：共计%d个文件，约%s", estimate.Provider, estimate.Provinces, estimate.Total, formatBytes(estimate.Bytes)))
+	if !estimate.SizeSampled {
+		buf.WriteString("（部分层级缺少瓦片大小样本，按默认大小估算）")
+	}
+	if estimate.Seconds > 0 {
+		buf.WriteString(fmt.Sprintf("，按当前每秒%.1f个文件的速度预计耗时%s。\n", estimate.TilesPerSecond, formatDuration(estimate.Seconds)))
+	} else {
+		buf.WriteString("，暂无下载速度数据，无法估算耗时。\n")
+	}
+	for _, zoom := range estimate.Zooms {
+		buf.WriteString(fmt.Sprintf("第%d级：%d个文件，约%s\n", zoom.ZoomLevel, zoom.Tiles, formatBytes(zoom.Bytes)))
+	}
+	return buf.String()
+}
+
+// formatBytes 定义
+func formatBytes(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// formatDuration 定义
+func formatDuration(seconds float64) string {
+	duration := time.Duration(seconds) * time.Second
+	days := int(duration.Hours()) / 24
+	hours := int(duration.Hours()) % 24
+	minutes := int(duration.Minutes()) % 60
+	if days > 0 {
+		return fmt.Sprintf("%d天%d小时%d分钟", days, hours, minutes)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%d小时%d分钟", hours, minutes)
+	}
+	return fmt.Sprintf("%d分钟%d秒", minutes, int(duration.Seconds())%60)
+}
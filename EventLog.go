@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxJobEvents 每个任务保留的事件数，不含进度消息
+	maxJobEvents = 1000
+	// replayJobEvents 订阅任务时补发的最近事件数
+	replayJobEvents = 100
+)
+
+// LoggedEvent 定义
+// 已发送的任务事件，data为发送时的原始消息，补发时原样发送。
+type LoggedEvent struct {
+	Time time.Time `json:"time"`
+	*Envelope
+	data []byte
+}
+
+// jobEventLog 定义
+// progress消息很多，只保留最近的一条作为任务的当前状态，
+// 按seq排序后自然排在它之前和之后的事件之间。
+type jobEventLog struct {
+	events   []*LoggedEvent
+	progress *LoggedEvent
+}
+
+// EventLog 定义
+// 按任务保存已发送的事件，供新连接补发和HTTP查询。
+type EventLog struct {
+	jobs map[int]*jobEventLog
+	mu   sync.Mutex
+}
+
+// NewEventLog 定义
+func NewEventLog() *EventLog {
+	return &EventLog{jobs: make(map[int]*jobEventLog)}
+}
+
+// Append 定义
+// 不属于任何任务的事件不保存。
+func (eventLog *EventLog) Append(envelope *Envelope, data []byte) {
+	if envelope.JobID == 0 {
+		return
+	}
+	event := &LoggedEvent{time.Now(), envelope, data}
+	eventLog.mu.Lock()
+	defer eventLog.mu.Unlock()
+	jobLog, ok := eventLog.jobs[envelope.JobID]
+	if !ok {
+		jobLog = new(jobEventLog)
+		eventLog.jobs[envelope.JobID] = jobLog
+	}
+	if envelope.Type == MessageTypeProgress {
+		jobLog.progress = event
+		return
+	}
+	if len(jobLog.events) >= maxJobEvents {
+		copy(jobLog.events, jobLog.events[1:])
+		jobLog.events = jobLog.events[:len(jobLog.events)-1]
+	}
+	jobLog.events = append(jobLog.events, event)
+}
+
+// Remove 定义
+// 删除任务的全部事件，任务管理删除已结束的任务时调用。
+func (eventLog *EventLog) Remove(jobID int) {
+	eventLog.mu.Lock()
+	delete(eventLog.jobs, jobID)
+	eventLog.mu.Unlock()
+}
+
+// Events 定义
+// 返回任务保存的全部事件，按seq排序。
+func (eventLog *EventLog) Events(jobID int) []*LoggedEvent {
+	return eventLog.recent(jobID, maxJobEvents)
+}
+
+// Recent 定义
+// 返回任务的当前进度和最近的事件，按seq排序。
+func (eventLog *EventLog) Recent(jobID int) []*LoggedEvent {
+	return eventLog.recent(jobID, replayJobEvents)
+}
+
+// Since 定义
+// 返回任务在seq之后发送的事件，用于断线后继续接收。
+func (eventLog *EventLog) Since(jobID int, seq uint64) []*LoggedEvent {
+	events := eventLog.Events(jobID)
+	i := sort.Search(len(events), func(i int) bool { return events[i].Seq > seq })
+	return events[i:]
+}
+
+// recent 定义
+func (eventLog *EventLog) recent(jobID int, count int) []*LoggedEvent {
+	eventLog.mu.Lock()
+	defer eventLog.mu.Unlock()
+	jobLog, ok := eventLog.jobs[jobID]
+	if !ok {
+		return []*LoggedEvent{}
+	}
+	events := jobLog.events
+	if len(events) > count {
+		events = events[len(events)-count:]
+	}
+	result := make([]*LoggedEvent, len(events), len(events)+1)
+	copy(result, events)
+	if jobLog.progress != nil {
+		result = append(result, jobLog.progress)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Seq < result[j].Seq })
+	return result
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveEvents 定义
+// 以Server-Sent Events发送与WebSocket相同的消息，供无法使用WebSocket的网络环境：
+//
+//	GET /events?jobs=1,2  订阅任务，每条消息的id为消息的seq
+//
+// 断线后浏览器会带上Last-Event-ID重新连接，补发该消息之后的任务事件；
+// 手动重新连接时可用lastEventId参数代替。不属于任务的消息不会补发。
+func (service *WebSocketService) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", 500)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	resumeSeq, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// 避免反向代理缓冲消息
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	c := newConnection(nil, r, resumeSeq)
+	service.h.register <- c
+	defer func() {
+		service.h.unregister <- c
+	}()
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			// 按Last-Event-ID补发的事件由本goroutine逐条写出，不经过发送缓冲
+			for _, event := range message.events() {
+				if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Seq, event.data); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			// 注释行，保持代理和浏览器的连接
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveMessages 定义
+// 以HTTP POST发送与WebSocket相同的submit和command消息，响应为回复的消息。
+// 订阅任务请使用/events的jobs参数。
+func (service *WebSocketService) serveMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		writeJSON(w, 400, ErrorResponseStruct{err.Error()})
+		return
+	}
+	requester := &httpRequester{}
+	request, err := ParseEnvelope(data)
+	if err == nil && (request.Type == MessageTypeSubscribe || request.Type == MessageTypeUnsubscribe) {
+		err = fmt.Errorf("HTTP请求不支持%s，请使用/events的jobs参数订阅任务", request.Type)
+	}
+	if err == nil && service.requestCallback == nil {
+		err = fmt.Errorf("不支持的消息类型%s", request.Type)
+	}
+	var replyTo uint64
+	if request != nil {
+		replyTo = request.Seq
+	}
+	if err != nil {
+		requester.Reply(&JobEvent{MessageTypeError, 0, ErrorPayload{EventText{err.Error()}, err.Error()}})
+	} else {
+		service.requestCallback(request, requester)
+	}
+
+	envelope, _, err := service.encode(requester.event, replyTo)
+	if err != nil {
+		writeJSON(w, 500, ErrorResponseStruct{err.Error()})
+		return
+	}
+	statusCode := 200
+	if envelope.Type != MessageTypeAccepted {
+		statusCode = 400
+	}
+	writeJSON(w, statusCode, envelope)
+}
+
+// httpRequester 定义
+// 保存对HTTP请求的回复。HTTP请求没有连接可以订阅，Watch和Unwatch不做任何事。
+type httpRequester struct {
+	event *JobEvent
+}
+
+// Reply 定义
+func (requester *httpRequester) Reply(event *JobEvent) {
+	requester.event = event
+}
+
+// Watch 定义
+func (requester *httpRequester) Watch(jobID int) {}
+
+// Unwatch 定义
+func (requester *httpRequester) Unwatch(jobID int) {}
@@ -1,39 +1,58 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
-	"net/http"
+	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // GetBaiduMap 定义
 type GetBaiduMap struct {
-	threadCount              int
-	baiduMapServer           *BaiduMapServerInfo
-	errorList                *DownloadErrorInfo
-	listCapacity             int
-	currentDownloadTimes     int
-	channel                  chan int
-	config                   *ConfigStruct
-	downloadFlag             bool
-	broadcastMessageCallback BroadcastMessageCallback
-	jobStatus                JobStatus
-}
-
-// BaiduMapServerInfo 定义
-type BaiduMapServerInfo struct {
-	MinServerID     int
-	MaxServerID     int
-	CurrentServerID int
+	threadCount          int
+	provider             TileProvider
+	httpClient           *TileHTTPClient
+	rateLimiter          *RateLimiter
+	storage              TileStorage
+	manifest             *TileManifest
+	errorList            *DownloadErrorInfo
+	listCapacity         int
+	currentDownloadTimes int
+	channel              chan int
+	config               *ConfigStruct
+	downloadFlag         bool
+	eventCallback        EventCallback
+	jobStatus            JobStatus
+	pause                *PauseController
+	cancelFunc           context.CancelFunc
+	checkpoint           *JobCheckpoint
+	resuming             bool
+	concurrency          *ConcurrencyController
+	statistics           *TileStatistics
+	metrics              *Metrics
+	jobID                int
+	jobPath              string
+	skipExisting         bool
+	updating             bool
+	emptyTilePolicy      string
+	dedupe               bool
+	// retryPermanent为true时上一轮的永久性错误也重新下载
+	retryPermanent bool
+	// maxDownloadTimes大于0时本次最多下载这么多轮，之后仍失败的文件留给retry
+	maxDownloadTimes int
+	previousErrors   map[MapProperties]*TileErrorRecord
+	mu               sync.Mutex
 }
 
 // MapProperties 定义
@@ -45,12 +64,33 @@ type MapProperties struct {
 // JobStatus 定义
 type JobStatus struct {
 	counter, total, errorCounter uint64
+	skipCounter                  uint64
+	// permanentCounter 失败的瓦片中不再重试的数量
+	permanentCounter uint64
+	// blankCounter、placeholderCounter 下载到的空白瓦片和占位瓦片数量
+	blankCounter, placeholderCounter uint64
 }
 
 // DownloadParaStruct 定义
 type DownloadParaStruct struct {
 	minZoomLevel, maxZoomLevel int
 	provinces                  string
+	provider                   string
+	storage                    string
+	areas                      []AreaStruct
+	// jobPath不为空时下载到已有的任务目录，并跳过其中已存在的瓦片
+	jobPath      string
+	skipExisting bool
+	// update为true时重新下载已有任务的全部瓦片，只保存内容有变化的瓦片
+	update bool
+	// emptyTilePolicy 空白和占位瓦片的处理方式，为空时使用配置中的EmptyTilePolicy
+	emptyTilePolicy string
+	// dedupe为true时相同内容的瓦片只保存一份
+	dedupe bool
+	// polygons不为空时直接使用，不再根据provinces和areas计算
+	polygons []PolygonStruct
+	// existingPolygons 已有任务目录的断点中记录的区域，与本次的区域一起下载
+	existingPolygons []PolygonStruct
 }
 
 // RectAreaStruct 定义
@@ -61,11 +101,87 @@ type RectAreaStruct struct {
 	right  float64
 }
 
-// BroadcastMessageCallback 定义
-type BroadcastMessageCallback func(message string)
+var errJobCancelled = errors.New("job cancelled")
+
+// 瓦片下载失败原因定义
+const (
+	TileErrorNetwork     = "network"
+	TileErrorTimeout     = "timeout"
+	TileErrorHTTPStatus  = "http_status"
+	TileErrorInvalidTile = "invalid_tile"
+	TileErrorEmptyBody   = "empty_body"
+	TileErrorBlankTile   = "blank_tile"
+	TileErrorPlaceholder = "placeholder_tile"
+)
+
+// TileError 定义
+type TileError struct {
+	Reason     string
+	StatusCode int
+	Err        error
+}
+
+// Error 定义
+func (tileError *TileError) Error() string {
+	if tileError.Reason == TileErrorHTTPStatus {
+		return fmt.Sprintf("%s %d", tileError.Reason, tileError.StatusCode)
+	}
+	if tileError.Err != nil {
+		return fmt.Sprintf("%s: %s", tileError.Reason, tileError.Err.Error())
+	}
+	return tileError.Reason
+}
+
+// newNetworkError 定义
+func newNetworkError(err error) *TileError {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TileError{Reason: TileErrorTimeout, Err: err}
+	}
+	return &TileError{Reason: TileErrorNetwork, Err: err}
+}
+
+// permanentStatus 定义
+func permanentStatus(statusCode int) bool {
+	return statusCode == 404 || statusCode == 410
+}
+
+// permanentReason 定义
+// 瓦片不存在（404、410），或按任务设置空白、占位瓦片记为错误时，重试没有意义。
+func permanentReason(reason string, statusCode int) bool {
+	switch reason {
+	case TileErrorHTTPStatus:
+		return permanentStatus(statusCode)
+	case TileErrorBlankTile, TileErrorPlaceholder:
+		return true
+	}
+	return false
+}
+
+// isPermanentError 定义
+func isPermanentError(err error) bool {
+	var tileError *TileError
+	return errors.As(err, &tileError) && permanentReason(tileError.Reason, tileError.StatusCode)
+}
+
+// isThrottleError 定义
+// 403、429、5xx、超时和无效瓦片通常意味着服务器在限流，需要降低并发。
+func isThrottleError(err error) bool {
+	var tileError *TileError
+	if !errors.As(err, &tileError) {
+		return false
+	}
+	switch tileError.Reason {
+	case TileErrorTimeout, TileErrorInvalidTile, TileErrorEmptyBody:
+		return true
+	case TileErrorHTTPStatus:
+		return tileError.StatusCode == 403 || tileError.StatusCode == 429 || tileError.StatusCode >= 500
+	}
+	return false
+}
 
 // NewGetBaiduMap 定义
-func NewGetBaiduMap(config *ConfigStruct, broadcastMessageCallback BroadcastMessageCallback) *GetBaiduMap {
+func NewGetBaiduMap(config *ConfigStruct, eventCallback EventCallback) *GetBaiduMap {
 	instance := new(GetBaiduMap)
 
 	instance.downloadFlag = false
@@ -73,122 +189,345 @@ func NewGetBaiduMap(config *ConfigStruct, broadcastMessageCallback BroadcastMess
 	instance.config = config
 	instance.listCapacity = config.ProcessListCapacity
 
-	instance.baiduMapServer = &BaiduMapServerInfo{
-		MinServerID: 0, MaxServerID: 3, CurrentServerID: 0,
-	}
 	instance.errorList = &DownloadErrorInfo{
 		listCaption: config.ProcessErrorListCapacity,
 	}
 	instance.threadCount = config.AllowedThreadCount
 	instance.channel = make(chan int, instance.threadCount)
-	instance.broadcastMessageCallback = broadcastMessageCallback
+	instance.eventCallback = eventCallback
+	instance.pause = NewPauseController()
 	instance.Init()
 	return instance
 }
 
 // Init 定义
 func (instance *GetBaiduMap) Init() {
-	instance.baiduMapServer.CurrentServerID = instance.baiduMapServer.MinServerID
 	atomic.StoreUint64(&instance.jobStatus.counter, 0)
 	atomic.StoreUint64(&instance.jobStatus.total, 0)
 	atomic.StoreUint64(&instance.jobStatus.errorCounter, 0)
+	atomic.StoreUint64(&instance.jobStatus.skipCounter, 0)
+	atomic.StoreUint64(&instance.jobStatus.permanentCounter, 0)
+	instance.mu.Lock()
+	instance.previousErrors = make(map[MapProperties]*TileErrorRecord)
+	instance.mu.Unlock()
 }
 
 // getImageFromURL 定义
-func (instance *GetBaiduMap) getImageFromURL(url *string) (content []byte, err error) {
-	resp, err1 := http.Get(*url)
+func (instance *GetBaiduMap) getImageFromURL(ctx context.Context, url *string) (content []byte, err error) {
+	if instance.rateLimiter != nil {
+		if err = instance.rateLimiter.WaitRequest(ctx, *url); err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	var duration time.Duration
+	// 超时和网络错误的请求也计入耗时
+	defer func() {
+		if duration == 0 {
+			duration = time.Since(start)
+		}
+		instance.metrics.ObserveRequest(urlHost(*url), duration)
+	}()
+	resp, err1 := instance.httpClient.Get(*url)
 	if err1 != nil {
-		err = err1
+		err = newNetworkError(err1)
 		return
 	}
 	defer resp.Body.Close()
 	data, err2 := ioutil.ReadAll(resp.Body)
 	if err2 != nil {
-		err = err2
+		err = newNetworkError(err2)
 		return
 	}
 	resp.Body.Close()
+	duration = time.Since(start)
+	instance.metrics.AddBytes(instance.provider.Name(), len(data))
+	if instance.rateLimiter != nil {
+		if err = instance.rateLimiter.WaitBytes(ctx, len(data)); err != nil {
+			return
+		}
+	}
 
 	statusCode := resp.StatusCode
 	if statusCode != 200 {
-		message := fmt.Sprintf("StatusCode is error! URL: %s", *url)
-		err = errors.New(message)
+		err = &TileError{Reason: TileErrorHTTPStatus, StatusCode: statusCode}
 		return
 	}
 
-	if data != nil && len(data) > 4 {
-		if data[1] == 'P' && data[2] == 'N' && data[3] == 'G' {
-			content = data
-		}
+	if len(data) == 0 {
+		err = &TileError{Reason: TileErrorEmptyBody}
+		return
 	}
-	return
-}
-
-// WriteImageToFile 定义
-func (instance *GetBaiduMap) WriteImageToFile(raw []byte, pathName string, fileName string) (err error) {
-	if raw != nil {
-		err = os.MkdirAll(pathName, 0777)
-		if err != nil {
-			return
-		}
-		err = ioutil.WriteFile(fileName, raw, 0644)
+	if !instance.provider.ValidTile(data) {
+		err = &TileError{Reason: TileErrorInvalidTile}
+		return
 	}
+	content = data
 	return
 }
 
-var urlTemplate = "http://online%d.map.bdimg.com/onlinelabel/?qt=tile&x=%d&y=%d&z=%d&styles=pl&scaler=1&udt=%s"
-
 // downloadMap 定义
-func (instance *GetBaiduMap) downloadAMapTile(jobPath *string, mapProperties *MapProperties) (err error) {
-	if instance.baiduMapServer.CurrentServerID > instance.baiduMapServer.MaxServerID {
-		instance.baiduMapServer.CurrentServerID = 0
+// 更新任务中瓦片是新增、有变化还是未变化计入result。
+func (instance *GetBaiduMap) downloadAMapTile(ctx context.Context, jobPath *string, mapProperties *MapProperties, result *batchResult) (err error) {
+	udt := tileUDT(time.Now())
+	url := instance.provider.TileURL(mapProperties, udt)
+
+	var raw []byte
+	raw, err = instance.getImageFromURL(ctx, &url)
+	if err != nil {
+		return
 	}
-	url := fmt.Sprintf(urlTemplate, instance.baiduMapServer.CurrentServerID, mapProperties.x, mapProperties.y, mapProperties.zoomLevel, time.Now().Format("20060102"))
-	instance.baiduMapServer.CurrentServerID++
-	url = strings.Replace(url, "-", "M", 0)
 
-	pathName := fmt.Sprintf("%s/%d/%d/", *jobPath, mapProperties.zoomLevel, mapProperties.x)
-	fileName := fmt.Sprintf("%s/%d.png", pathName, mapProperties.y)
+	if raw == nil {
+		return
+	}
+	if instance.statistics != nil {
+		instance.statistics.RecordTile(instance.provider.Name(), mapProperties.zoomLevel, len(raw))
+	}
 
-	var raw []byte
-	raw, err = instance.getImageFromURL(&url)
+	hash := sha256.Sum256(raw)
+	kind, err := instance.config.TileValidator.Validate(raw, hash)
 	if err != nil {
 		return
 	}
+	if kind != TileKindNormal {
+		switch kind {
+		case TileKindBlank:
+			atomic.AddUint64(&instance.jobStatus.blankCounter, 1)
+		case TileKindPlaceholder:
+			atomic.AddUint64(&instance.jobStatus.placeholderCounter, 1)
+		}
+		switch instance.emptyTilePolicy {
+		case EmptyTileSkip:
+			instance.manifest.RecordSkipped(mapProperties, udt, hash, len(raw))
+			return
+		case EmptyTileError:
+			if kind == TileKindBlank {
+				return &TileError{Reason: TileErrorBlankTile}
+			}
+			return &TileError{Reason: TileErrorPlaceholder}
+		}
+	}
 
-	err = instance.WriteImageToFile(raw, pathName, fileName)
+	update := TileAdded
+	if instance.updating {
+		var previous []byte
+		if _, ok := instance.manifest.Get(mapProperties); !ok {
+			// 没有清单记录的旧任务与已保存的瓦片比较
+			previous, _ = instance.storage.ReadTile(mapProperties)
+		}
+		update = instance.manifest.Compare(mapProperties, hash, previous)
+	}
+	if update != TileUnchanged {
+		linker, ok := instance.storage.(TileLinker)
+		if ok && (instance.dedupe || (kind != TileKindNormal && instance.emptyTilePolicy == EmptyTileDedupe)) {
+			err = linker.LinkTile(mapProperties, raw, hash)
+		} else {
+			err = instance.storage.WriteTile(mapProperties, raw)
+		}
+		if err != nil {
+			return
+		}
+	}
+	instance.manifest.Record(mapProperties, udt, hash, len(raw))
+	if instance.updating {
+		result.addUpdate(update)
+	}
 	return
 }
 
 // downloadMapBySlices 定义
-func (instance *GetBaiduMap) downloadMapBySlices(jobPath *string, mapProperties []*MapProperties, c chan int, j *JobStatus) {
-	errMapProperties := make([]*MapProperties, 0, instance.errorList.listCaption)
+func (instance *GetBaiduMap) downloadMapBySlices(ctx context.Context, jobPath *string, mapProperties []*MapProperties, batch int64, c chan int, j *JobStatus) {
+	errRecords := make([]*TileErrorRecord, 0, instance.errorList.listCaption)
+	completed := true
+	var result batchResult
+	instance.metrics.WorkerStarted()
+	defer instance.metrics.WorkerStopped()
+	fail := func(record *TileErrorRecord) {
+		record.Batch = batch
+		atomic.AddUint64(&j.errorCounter, 1)
+		result.errorCounter++
+		if record.Permanent() {
+			atomic.AddUint64(&j.permanentCounter, 1)
+			result.permanentCounter++
+		}
+		errRecords = append(errRecords, record)
+		if len(errRecords) >= instance.errorList.listCaption {
+			instance.errorList.Append(errRecords)
+			errRecords = make([]*TileErrorRecord, 0, instance.errorList.listCaption)
+		}
+	}
 	for _, value := range mapProperties {
-		if value.zoomLevel == 0 {
-			return
+		if instance.pause.Wait(ctx) != nil {
+			completed = false
+			break
+		}
+		previous := instance.takePreviousError(value)
+		if previous != nil && previous.Permanent() && !instance.retryPermanent {
+			// 永久性错误（如404）不再重试，直接记入本轮的错误列表，已在首次失败时计入metrics
+			fail(previous)
+			continue
+		}
+		if instance.skipExisting && instance.tileExists(value) {
+			instance.metrics.TileSkipped(instance.provider.Name(), value.zoomLevel)
+			atomic.AddUint64(&j.counter, 1)
+			atomic.AddUint64(&j.skipCounter, 1)
+			result.counter++
+			continue
 		}
-		for i := 0; i < 3; i++ {
-			err := instance.downloadAMapTile(jobPath, value)
-			if err == nil {
-				atomic.AddUint64(&j.counter, 1)
+		var err error
+		attempts := 0
+		for attempts < 3 {
+			// 重试前按指数退避等待，等待期间不占用并发名额
+			if attempts > 0 && sleepContext(ctx, retryDelay(attempts-1)) != nil {
 				break
 			}
-			if i >= 2 {
-				atomic.AddUint64(&j.errorCounter, 1)
-				errMapProperties = append(errMapProperties, value)
-				if len(errMapProperties) >= instance.errorList.listCaption {
-					instance.errorList.Append(errMapProperties)
-					errMapProperties = make([]*MapProperties, 0, instance.errorList.listCaption)
-				}
+			if !instance.acquireWorker(ctx) {
+				break
+			}
+			attempts++
+			err = instance.downloadAMapTile(ctx, jobPath, value, &result)
+			instance.releaseWorker()
+			if err == nil || ctx.Err() != nil {
 				break
 			}
-			time.Sleep(10)
+			instance.reportResult(err)
+			if isPermanentError(err) {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			completed = false
+			break
+		}
+		if err == nil {
+			instance.reportResult(nil)
+			instance.metrics.TileFetched(instance.provider.Name(), value.zoomLevel)
+			atomic.AddUint64(&j.counter, 1)
+			result.counter++
+			continue
+		}
+		if previous != nil {
+			attempts += previous.Attempts
 		}
+		record := newTileErrorRecord(value, err, attempts)
+		instance.metrics.TileFailed(instance.provider.Name(), record.Z, record.Reason)
+		fail(record)
+	}
+	instance.errorList.Append(errRecords)
+	if completed && instance.checkpoint.BatchDone(batch, result) {
+		instance.saveCheckpoint()
 	}
-	instance.errorList.Append(errMapProperties)
 	c <- 1
 }
 
+// setPreviousError 定义
+// 重试轮次中记录瓦片上一轮的失败信息，供下载线程判断是否重试并累计尝试次数。
+func (instance *GetBaiduMap) setPreviousError(record *TileErrorRecord) {
+	instance.mu.Lock()
+	instance.previousErrors[*record.MapProperties()] = record
+	instance.mu.Unlock()
+}
+
+// takePreviousError 定义
+func (instance *GetBaiduMap) takePreviousError(mapProperties *MapProperties) *TileErrorRecord {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	record, ok := instance.previousErrors[*mapProperties]
+	if ok {
+		delete(instance.previousErrors, *mapProperties)
+	}
+	return record
+}
+
+// tileExists 定义
+// 已保存且内容完整的瓦片不再重新下载。
+// 按skip方式没有保存的空白和占位瓦片也视为已存在。
+func (instance *GetBaiduMap) tileExists(mapProperties *MapProperties) bool {
+	if instance.emptyTilePolicy == EmptyTileSkip && instance.manifest.Skipped(mapProperties) {
+		return true
+	}
+	data, err := instance.storage.ReadTile(mapProperties)
+	return err == nil && instance.provider.ValidTile(data) && isCompleteImage(data)
+}
+
+// acquireWorker 定义
+// 所有任务共享concurrency，同一时刻正在下载的瓦片数不超过其当前的并发数。
+func (instance *GetBaiduMap) acquireWorker(ctx context.Context) bool {
+	if instance.concurrency == nil {
+		return true
+	}
+	return instance.concurrency.Acquire(ctx)
+}
+
+// releaseWorker 定义
+func (instance *GetBaiduMap) releaseWorker() {
+	if instance.concurrency != nil {
+		instance.concurrency.Release()
+	}
+}
+
+// reportResult 定义
+func (instance *GetBaiduMap) reportResult(err error) {
+	if instance.concurrency == nil {
+		return
+	}
+	if err == nil {
+		instance.concurrency.Success()
+	} else if isThrottleError(err) {
+		instance.concurrency.Throttled()
+	}
+}
+
+// dispatchSlice 定义
+func (instance *GetBaiduMap) dispatchSlice(ctx context.Context, jobPath *string, mapPropertiesList []*MapProperties, batch int64, threadCounter *int) {
+	if *threadCounter >= instance.threadCount {
+		<-instance.channel
+		*threadCounter--
+	}
+	go instance.downloadMapBySlices(ctx, jobPath, mapPropertiesList, batch, instance.channel, &instance.jobStatus)
+	*threadCounter++
+}
+
+// startRound 定义
+// 从断点恢复时沿用断点中的计数并返回需要跳过的批次数，否则开始新的一轮。
+func (instance *GetBaiduMap) startRound(jobPath string) (skip int64) {
+	atomic.StoreUint64(&instance.jobStatus.skipCounter, 0)
+	atomic.StoreUint64(&instance.jobStatus.blankCounter, 0)
+	atomic.StoreUint64(&instance.jobStatus.placeholderCounter, 0)
+	if instance.resuming {
+		instance.resuming = false
+		data := instance.checkpoint.Snapshot()
+		skip = data.CompletedBatch
+		atomic.StoreUint64(&instance.jobStatus.total, data.Total)
+		atomic.StoreUint64(&instance.jobStatus.counter, data.Counter)
+		atomic.StoreUint64(&instance.jobStatus.errorCounter, data.ErrorCounter)
+		atomic.StoreUint64(&instance.jobStatus.permanentCounter, data.PermanentErrorCounter)
+		instance.errorList.InitSave(instance.currentDownloadTimes, jobPath, true, skip)
+		return
+	}
+	instance.metrics.RoundStarted(instance.provider.Name(), instance.currentDownloadTimes > 0)
+	instance.checkpoint.StartRound(instance.currentDownloadTimes, atomic.LoadUint64(&instance.jobStatus.total))
+	instance.errorList.InitSave(instance.currentDownloadTimes, jobPath, false, 0)
+	instance.saveCheckpoint()
+	return
+}
+
+// saveCheckpoint 定义
+func (instance *GetBaiduMap) saveCheckpoint() {
+	// 先写入缓存的瓦片，保证断点中记录完成的瓦片都已保存
+	if err := instance.storage.Flush(); err != nil {
+		fmt.Println(err.Error())
+	}
+	if err := instance.manifest.Flush(); err != nil {
+		fmt.Println(err.Error())
+	}
+	instance.errorList.Flush()
+	if err := instance.checkpoint.Save(); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
 // createJobPath 定义
 func (instance *GetBaiduMap) createJobPath() (jobPath string, err error) {
 	relativePath, err := os.Getwd()
@@ -198,60 +537,80 @@ func (instance *GetBaiduMap) createJobPath() (jobPath string, err error) {
 	}
 	tmpPath := fmt.Sprintf("%s/map/", relativePath)
 
-	_, tmpErr := os.Stat(tmpPath)
-	if tmpErr == nil {
-		for i := 1; ; i++ {
-			tmpPath = fmt.Sprintf("%s/map%d/", relativePath, i)
-			_, tmpErr := os.Stat(tmpPath)
-			if tmpErr != nil {
-				break
-			}
+	// 多个任务可能同时创建目录，使用Mkdir保证每个任务得到不同的目录
+	for i := 1; ; i++ {
+		err = os.Mkdir(tmpPath, 0777)
+		if err == nil {
+			jobPath = tmpPath
+			return
 		}
+		if !os.IsExist(err) {
+			return
+		}
+		tmpPath = fmt.Sprintf("%s/map%d/", relativePath, i)
 	}
-
-	err = os.MkdirAll(tmpPath, 0777)
-	if err == nil {
-		jobPath = tmpPath
-	}
-	return
 }
 
 // getDownloadingAreas 定义
-func (instance *GetBaiduMap) getDownloadingAreas(provincesStr string) []RectAreaStruct {
+// 矩形区域先合并再转为多边形，GeoJSON区域按多边形转换坐标系后直接参与瓦片枚举。
+func (instance *GetBaiduMap) getDownloadingAreas(para *DownloadParaStruct) []PolygonStruct {
 	var tempRectAreas []RectAreaStruct
-	provinces := strings.Split(provincesStr, ",")
+	polygons := make([]PolygonStruct, 0, 100)
+	provinces := strings.Split(para.provinces, ",")
 
+	areas := make([]AreaStruct, 0, len(provinces)+len(para.areas))
 	for _, value := range instance.config.ProvinceInformation {
 		for _, province := range provinces {
 			if province == value.province {
-				var rect RectAreaStruct
-				longitude := value.area.longitude
-				latitude := value.area.latitude
-				if longitude[0] < longitude[1] {
-					rect.left = longitude[0]
-					rect.right = longitude[1]
-				} else {
-					rect.left = longitude[1]
-					rect.right = longitude[0]
-				}
-				if latitude[0] < latitude[1] {
-					rect.top = latitude[0]
-					rect.bottom = latitude[1]
-				} else {
-					rect.top = latitude[1]
-					rect.bottom = latitude[0]
-				}
-				if tempRectAreas == nil {
-					tempRectAreas = make([]RectAreaStruct, 1, 100)
-					tempRectAreas[0] = rect
-				} else {
-					tempRectAreas = append(tempRectAreas, rect)
-				}
+				areas = append(areas, value.area)
 			}
 		}
 	}
+	for _, area := range para.areas {
+		if area.datum == "" {
+			area.datum = instance.config.DefaultDatum
+		}
+		areas = append(areas, area)
+	}
+
+	for _, area := range areas {
+		if len(area.polygons) > 0 {
+			for _, polygon := range area.polygons {
+				polygons = append(polygons, convertPolygon(polygon, area.datum, instance.provider.Datum()))
+			}
+			continue
+		}
+		var rect RectAreaStruct
+		longitude := area.longitude
+		latitude := area.latitude
+		if longitude[0] < longitude[1] {
+			rect.left = longitude[0]
+			rect.right = longitude[1]
+		} else {
+			rect.left = longitude[1]
+			rect.right = longitude[0]
+		}
+		if latitude[0] < latitude[1] {
+			rect.top = latitude[0]
+			rect.bottom = latitude[1]
+		} else {
+			rect.top = latitude[1]
+			rect.bottom = latitude[0]
+		}
+		// 转换到地图源使用的坐标系后再计算瓦片范围
+		rect = convertRectArea(rect, area.datum, instance.provider.Datum())
+		if tempRectAreas == nil {
+			tempRectAreas = make([]RectAreaStruct, 1, 100)
+			tempRectAreas[0] = rect
+		} else {
+			tempRectAreas = append(tempRectAreas, rect)
+		}
+	}
 	validRectAreas := instance.UnionRectAreas(tempRectAreas)
-	return validRectAreas
+	for _, rect := range validRectAreas {
+		polygons = append(polygons, rectPolygon(rect))
+	}
+	return polygons
 }
 
 // ChenkPointInRectAreas 定义
@@ -308,23 +667,11 @@ func (instance *GetBaiduMap) UnionRectAreas(rectAreas []RectAreaStruct) (validRe
 }
 
 // FetchMaps 定义
-func (instance *GetBaiduMap) fetchMaps(jobPath string, minZoom int, maxZoom int, rectAreas []RectAreaStruct) {
+func (instance *GetBaiduMap) fetchMaps(ctx context.Context, jobPath string, minZoom int, maxZoom int, polygons []PolygonStruct) {
 	instance.Init()
 	counter := uint64(0)
-	for zoomCounter := minZoom; zoomCounter <= maxZoom; zoomCounter++ {
-		cV := math.Pow(float64(2), float64(18-zoomCounter))
-		unitSize := cV * 256
-		for _, rectCounter := range rectAreas {
-			minX := int64(math.Floor((111320.7019*rectCounter.left + 0.02068) / unitSize))
-			maxX := int64(math.Floor((111320.7019*rectCounter.right + 0.02068) / unitSize))
-			minY := int64(math.Floor((137651.4674*rectCounter.top - 673284.9677) / unitSize))
-			maxY := int64(math.Floor((137651.4674*rectCounter.bottom - 673284.9677) / unitSize))
-			for xCounter := minX; xCounter <= maxX; xCounter++ {
-				for yCounter := minY; yCounter <= maxY; yCounter++ {
-					counter++
-				}
-			}
-		}
+	for _, zoomCounter := range instance.countTiles(minZoom, maxZoom, polygons) {
+		counter += zoomCounter
 	}
 
 	atomic.StoreUint64(&instance.jobStatus.total, counter)
@@ -333,95 +680,89 @@ func (instance *GetBaiduMap) fetchMaps(jobPath string, minZoom int, maxZoom int,
 	instance.putMessage(startMsg)
 
 	mapPropertiesList := make([]*MapProperties, 0, instance.listCapacity)
-	instance.currentDownloadTimes = 0
 	threadCounter := 0
-	instance.errorList.InitSave(instance.currentDownloadTimes, jobPath)
+	batch := int64(0)
+	skip := instance.startRound(jobPath)
 
 	for zoomLevel := minZoom; zoomLevel <= maxZoom; zoomLevel++ {
-		cV := math.Pow(float64(2), float64(18-zoomLevel))
-		unitSize := cV * 256
-		for _, rect := range rectAreas {
-			minX := int64(math.Floor((111320.7019*rect.left + 0.02068) / unitSize))
-			maxX := int64(math.Floor((111320.7019*rect.right + 0.02068) / unitSize))
-			minY := int64(math.Floor((137651.4674*rect.top - 673284.9677) / unitSize))
-			maxY := int64(math.Floor((137651.4674*rect.bottom - 673284.9677) / unitSize))
-			for x := minX; x <= maxX; x++ {
-				for y := minY; y <= maxY; y++ {
-					if len(mapPropertiesList) >= instance.listCapacity {
-						if threadCounter >= instance.threadCount {
-							<-instance.channel
-							threadCounter--
-						}
-
-						go instance.downloadMapBySlices(&jobPath, mapPropertiesList, instance.channel, &instance.jobStatus)
-						threadCounter++
-
-						mapPropertiesList = make([]*MapProperties, 0, instance.listCapacity)
-					}
-					mapProperties := &MapProperties{zoomLevel, x, y}
-					mapPropertiesList = append(mapPropertiesList, mapProperties)
+		completed := EnumeratePolygonTiles(instance.provider.Scheme(), zoomLevel, polygons, func(x, y int64) bool {
+			if len(mapPropertiesList) >= instance.listCapacity {
+				if instance.pause.Wait(ctx) != nil {
+					mapPropertiesList = mapPropertiesList[:0]
+					return false
+				}
+				if batch >= skip {
+					instance.dispatchSlice(ctx, &jobPath, mapPropertiesList, batch, &threadCounter)
 				}
+				batch++
+
+				mapPropertiesList = make([]*MapProperties, 0, instance.listCapacity)
 			}
+			mapProperties := &MapProperties{zoomLevel, x, y}
+			mapPropertiesList = append(mapPropertiesList, mapProperties)
+			return true
+		})
+		if !completed {
+			break
 		}
 	}
 
-	if len(mapPropertiesList) > 0 {
-		if threadCounter >= instance.threadCount {
-			<-instance.channel
-			threadCounter--
-		}
-		go instance.downloadMapBySlices(&jobPath, mapPropertiesList, instance.channel, &instance.jobStatus)
-		threadCounter++
+	if len(mapPropertiesList) > 0 && ctx.Err() == nil && batch >= skip {
+		instance.dispatchSlice(ctx, &jobPath, mapPropertiesList, batch, &threadCounter)
 	}
 
 	for i := 0; i < threadCounter; i++ {
 		<-instance.channel
 	}
 	instance.errorList.CloseSave()
+	instance.saveCheckpoint()
 
+	if ctx.Err() != nil {
+		return
+	}
 	instance.currentDownloadTimes++
-	msg := fmt.Sprintf("第%d轮数据下载完成，共计%d个文件，%d个文件下载成功，%d个文件下载失败。", instance.currentDownloadTimes, atomic.LoadUint64(&instance.jobStatus.total), atomic.LoadUint64(&instance.jobStatus.counter), atomic.LoadUint64(&instance.jobStatus.errorCounter))
-	instance.putMessage(msg)
+	instance.putRoundComplete()
 }
 
-func (instance *GetBaiduMap) fetchErrorList(jobPath string, total uint64) {
+func (instance *GetBaiduMap) fetchErrorList(ctx context.Context, jobPath string, total uint64) {
 	instance.Init()
 	atomic.StoreUint64(&instance.jobStatus.total, total)
 
 	mapPropertiesList := make([]*MapProperties, 0, instance.listCapacity)
 	threadCounter := 0
+	batch := int64(0)
 
 	instance.errorList.InitLoad(instance.currentDownloadTimes-1, jobPath)
-	instance.errorList.InitSave(instance.currentDownloadTimes, jobPath)
+	skip := instance.startRound(jobPath)
 
+read:
 	for {
-		lines := instance.errorList.ReadLine()
-		if lines == nil {
+		records := instance.errorList.ReadLine()
+		if records == nil {
 			break
 		}
-		for _, value := range lines {
+		for _, record := range records {
 			if len(mapPropertiesList) >= instance.listCapacity {
-				if threadCounter >= instance.threadCount {
-					<-instance.channel
-					threadCounter--
+				if instance.pause.Wait(ctx) != nil {
+					mapPropertiesList = mapPropertiesList[:0]
+					break read
 				}
-				go instance.downloadMapBySlices(&jobPath, mapPropertiesList, instance.channel, &instance.jobStatus)
-				threadCounter++
+				if batch >= skip {
+					instance.dispatchSlice(ctx, &jobPath, mapPropertiesList, batch, &threadCounter)
+				}
+				batch++
 
 				mapPropertiesList = make([]*MapProperties, 0, instance.listCapacity)
 			}
-			mapProperties := value
-			mapPropertiesList = append(mapPropertiesList, mapProperties)
+			if batch >= skip {
+				instance.setPreviousError(record)
+			}
+			mapPropertiesList = append(mapPropertiesList, record.MapProperties())
 		}
 	}
 
-	if len(mapPropertiesList) > 0 {
-		if threadCounter >= instance.threadCount {
-			<-instance.channel
-			threadCounter--
-		}
-		go instance.downloadMapBySlices(&jobPath, mapPropertiesList, instance.channel, &instance.jobStatus)
-		threadCounter++
+	if len(mapPropertiesList) > 0 && ctx.Err() == nil && batch >= skip {
+		instance.dispatchSlice(ctx, &jobPath, mapPropertiesList, batch, &threadCounter)
 	}
 
 	for i := 0; i < threadCounter; i++ {
@@ -429,108 +770,679 @@ func (instance *GetBaiduMap) fetchErrorList(jobPath string, total uint64) {
 	}
 	instance.errorList.CloseRead()
 	instance.errorList.CloseSave()
+	instance.saveCheckpoint()
 
+	if ctx.Err() != nil {
+		return
+	}
 	instance.currentDownloadTimes++
-	msg := fmt.Sprintf("第%d轮数据下载完成，共计%d个文件，%d个文件下载成功，%d个文件下载失败。", instance.currentDownloadTimes, atomic.LoadUint64(&instance.jobStatus.total), atomic.LoadUint64(&instance.jobStatus.counter), atomic.LoadUint64(&instance.jobStatus.errorCounter))
-	instance.putMessage(msg)
+	instance.putRoundComplete()
 }
 
-// createJobPath 定义
-func (instance *GetBaiduMap) analysePara(message []byte) (*DownloadParaStruct, error) {
+// analysePara 定义
+func analysePara(message []byte) (*DownloadParaStruct, error) {
 	var dat map[string]interface{}
 	if err := json.Unmarshal(message, &dat); err != nil {
-		fmt.Println(err.Error())
+		return nil, err
 	}
 
-	var minZoomLevel, maxZoomLevel, provinces string
-	if dat["MinZoomLevel"] != nil {
-		minZoomLevel = dat["MinZoomLevel"].(string)
+	minZoomLevel := paraString(dat, "MinZoomLevel")
+	maxZoomLevel := paraString(dat, "MaxZoomLevel")
+	provinces := paraString(dat, "Province")
+	provider := paraString(dat, "Provider")
+	storage := paraString(dat, "Storage")
+	jobPath := paraString(dat, "JobPath")
+	if strings.TrimSpace(jobPath) != "" {
+		var err error
+		jobPath, err = AbsJobPath(strings.TrimSpace(jobPath))
+		if err != nil {
+			return nil, err
+		}
 	}
-	if dat["MaxZoomLevel"] != nil {
-		maxZoomLevel = dat["MaxZoomLevel"].(string)
+	dedupe := paraString(dat, "Dedupe") == "true"
+	emptyTilePolicy := paraString(dat, "EmptyTilePolicy")
+	if emptyTilePolicy != "" && !validEmptyTilePolicy(emptyTilePolicy) {
+		return nil, fmt.Errorf("unknown empty tile policy %s", emptyTilePolicy)
 	}
-	if dat["Province"] != nil {
-		provinces = dat["Province"].(string)
+	areas, err := analyseAreas(dat)
+	if err != nil {
+		return nil, err
 	}
 	minZoom, err := strconv.Atoi(minZoomLevel)
 	if err != nil {
-		fmt.Println(err.Error())
 		return nil, err
 	}
 	maxZoom, err := strconv.Atoi(maxZoomLevel)
 	if err != nil {
-		fmt.Println(err.Error())
 		return nil, err
 	}
 	return &DownloadParaStruct{
-		minZoomLevel: minZoom,
-		maxZoomLevel: maxZoom,
-		provinces:    provinces,
+		minZoomLevel:    minZoom,
+		maxZoomLevel:    maxZoom,
+		provinces:       provinces,
+		provider:        provider,
+		storage:         storage,
+		areas:           areas,
+		jobPath:         jobPath,
+		skipExisting:    jobPath != "",
+		emptyTilePolicy: emptyTilePolicy,
+		dedupe:          dedupe,
 	}, nil
 }
 
-// download 定义
-func (instance *GetBaiduMap) download(message []byte) {
+// mergeJobCheckpoint 定义
+// 下载到已有的任务目录时，沿用断点中记录的地图源和保存方式，合并层级范围和区域，
+// 新的断点和MBTiles元数据包含原有的内容。地图源或保存方式与原任务不同时返回错误。
+func mergeJobCheckpoint(para *DownloadParaStruct) error {
+	if para.jobPath == "" || para.update {
+		return nil
+	}
+	checkpoint, err := LoadJobCheckpoint(para.jobPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("无法读取任务%s的断点信息：%s", para.jobPath, err.Error())
+	}
+	data := checkpoint.Snapshot()
+	if para.provider == "" {
+		para.provider = data.Provider
+	} else if para.provider != data.Provider {
+		return fmt.Errorf("任务目录%s的地图源为%s，不能下载%s的瓦片", para.jobPath, data.Provider, para.provider)
+	}
+	storage := data.Storage
+	if storage == "" {
+		storage = StorageFile
+	}
+	if para.storage == "" {
+		para.storage = storage
+	} else if para.storage != storage {
+		return fmt.Errorf("任务目录%s的保存方式为%s，不能改为%s", para.jobPath, storage, para.storage)
+	}
+	if data.MinZoomLevel < para.minZoomLevel {
+		para.minZoomLevel = data.MinZoomLevel
+	}
+	if data.MaxZoomLevel > para.maxZoomLevel {
+		para.maxZoomLevel = data.MaxZoomLevel
+	}
+	para.provinces = mergeProvinces(data.Provinces, para.provinces)
+	if para.emptyTilePolicy == "" {
+		para.emptyTilePolicy = data.EmptyTilePolicy
+	}
+	para.dedupe = para.dedupe || data.Dedupe
+	para.existingPolygons = checkpoint.Polygons()
+	return nil
+}
+
+// mergeProvinces 定义
+func mergeProvinces(existing, provinces string) string {
+	names := make([]string, 0)
+	found := make(map[string]bool)
+	for _, name := range strings.Split(existing+","+provinces, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !found[name] {
+			found[name] = true
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// analyseAreas 定义
+// 提交参数中的GeoJSON为多边形区域，Longitude、Latitude为逗号分隔的范围，Datum声明其坐标系。
+func analyseAreas(dat map[string]interface{}) (areas []AreaStruct, err error) {
+	datum, err := normalizeDatum(paraString(dat, "Datum"))
+	if err != nil {
+		return
+	}
+
+	geoJSON := paraString(dat, "GeoJSON")
+	if object, ok := dat["GeoJSON"].(map[string]interface{}); ok {
+		// REST接口可以直接提交GeoJSON对象
+		var data []byte
+		if data, err = json.Marshal(object); err != nil {
+			return
+		}
+		geoJSON = string(data)
+	}
+	if strings.TrimSpace(geoJSON) != "" {
+		var area AreaStruct
+		area.datum = datum
+		area.polygons, err = ParseGeoJSON([]byte(geoJSON))
+		if err != nil {
+			return
+		}
+		areas = append(areas, area)
+	}
+
+	longitudeStr := paraString(dat, "Longitude")
+	latitudeStr := paraString(dat, "Latitude")
+	if strings.TrimSpace(longitudeStr) == "" && strings.TrimSpace(latitudeStr) == "" {
+		return
+	}
+	var area AreaStruct
+	area.datum = datum
+	if area.longitude, err = parseRange(longitudeStr); err != nil {
+		return
+	}
+	if area.latitude, err = parseRange(latitudeStr); err != nil {
+		return
+	}
+	areas = append(areas, area)
+	return
+}
+
+// paraString 定义
+// 网页提交的参数都是字符串，REST接口还可以使用数字、布尔值和数组，数组按逗号连接。
+func paraString(dat map[string]interface{}, name string) string {
+	switch value := dat[name].(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return ""
+}
+
+// parseRange 定义
+func parseRange(value string) (result [2]float64, err error) {
+	values := strings.Split(value, ",")
+	if len(values) != 2 {
+		err = fmt.Errorf("invalid range %s", value)
+		return
+	}
+	for i := range values {
+		result[i], err = strconv.ParseFloat(strings.TrimSpace(values[i]), 64)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Download 定义
+func (instance *GetBaiduMap) Download(para *DownloadParaStruct) (err error) {
 	instance.setDownloadFlag(true)
 	defer instance.setDownloadFlag(false)
-	go instance.putProcessingMessage()
 
-	para, err1 := instance.analysePara(message)
-	if err1 != nil {
-		fmt.Println(err1.Error())
+	err = instance.setProvider(para.provider)
+	if err != nil {
+		fmt.Println(err.Error())
 		return
 	}
 
+	jobPath := para.jobPath
+	if jobPath == "" {
+		jobPath, err = instance.createJobPath()
+	} else {
+		err = checkJobPath(jobPath)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		instance.putMessage(err.Error())
+		return
+	}
+	instance.setJobPath(jobPath)
+	if para.update {
+		instance.putMessage(fmt.Sprintf("更新任务目录%s中的瓦片，只保存内容有变化的文件。", jobPath))
+	} else if para.jobPath != "" {
+		instance.putMessage(fmt.Sprintf("下载到已有的任务目录%s，跳过已下载的文件。", jobPath))
+	}
+
+	polygons := para.polygons
+	if polygons == nil {
+		polygons = append(instance.getDownloadingAreas(para), para.existingPolygons...)
+	}
+
+	err = instance.openStorage(jobPath, para, polygons)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer instance.closeStorage()
+
 	instance.currentDownloadTimes = 0
+	instance.resuming = false
+	instance.skipExisting = para.skipExisting
+	instance.updating = para.update
+	if para.emptyTilePolicy == "" {
+		para.emptyTilePolicy = instance.config.EmptyTilePolicy
+	}
+	instance.emptyTilePolicy = para.emptyTilePolicy
+	instance.dedupe = para.dedupe
+	instance.listCapacity = instance.config.ProcessListCapacity
+	instance.checkpoint = NewJobCheckpoint(jobPath, para, instance.listCapacity, polygons)
+	err = instance.execute(jobPath, para, polygons)
+	return
+}
 
-	jobPath, err2 := instance.createJobPath()
-	if err2 != nil {
-		fmt.Println(err2.Error())
+// ResumeJob 定义
+func (instance *GetBaiduMap) ResumeJob(jobPath string) error {
+	return instance.resumeJob(jobPath, false)
+}
+
+// RetryJob 定义
+// 未完成的任务从断点继续；已完成但仍有失败文件的任务再下载一轮失败的文件，永久性错误也重试。
+func (instance *GetBaiduMap) RetryJob(jobPath string) error {
+	return instance.resumeJob(jobPath, true)
+}
+
+// resumeJob 定义
+func (instance *GetBaiduMap) resumeJob(jobPath string, retry bool) (err error) {
+	instance.setDownloadFlag(true)
+	defer instance.setDownloadFlag(false)
+
+	jobPath, err = AbsJobPath(jobPath)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	instance.setJobPath(jobPath)
+
+	checkpoint, err := LoadJobCheckpoint(jobPath)
+	if err != nil {
+		fmt.Println(err.Error())
+		instance.putMessage(fmt.Sprintf("无法读取任务%s的断点信息。", jobPath))
+		return
+	}
+	data := checkpoint.Snapshot()
+	if data.Finished && (!retry || data.ErrorCounter == 0) {
+		instance.putMessage(fmt.Sprintf("任务%s已经下载完成。", jobPath))
+		return
+	}
+	if data.Finished {
+		checkpoint.Reopen()
+	}
+
+	err = instance.setProvider(data.Provider)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	err = instance.openStorage(jobPath, checkpoint.Para(), checkpoint.Polygons())
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer instance.closeStorage()
+
+	instance.currentDownloadTimes = data.DownloadTimes
+	if data.Finished {
+		// 从最后一轮的错误列表开始新的一轮
+		instance.currentDownloadTimes++
+	}
+	instance.resuming = !data.Finished
+	instance.retryPermanent = retry
+	instance.skipExisting = data.SkipExisting
+	instance.updating = data.Update
+	instance.emptyTilePolicy = data.EmptyTilePolicy
+	instance.dedupe = data.Dedupe
+	if instance.emptyTilePolicy == "" {
+		instance.emptyTilePolicy = instance.config.EmptyTilePolicy
+	}
+	instance.listCapacity = data.ListCapacity
+	instance.checkpoint = checkpoint
+	if data.Finished {
+		instance.putMessage(fmt.Sprintf("重新下载任务%s中%d个失败的文件。", jobPath, data.ErrorCounter))
+	} else {
+		msg := fmt.Sprintf("从断点恢复下载：第%d轮，已完成%d个文件。", data.DownloadTimes+1, data.Counter)
+		instance.putMessage(msg)
+	}
+	err = instance.execute(jobPath, checkpoint.Para(), checkpoint.Polygons())
+	return
+}
+
+// setProvider 定义
+func (instance *GetBaiduMap) setProvider(name string) (err error) {
+	instance.provider, err = instance.config.TileProvider(name)
+	if err != nil {
 		return
 	}
+	instance.httpClient = instance.config.HTTPClient(instance.provider.Name())
+	return
+}
+
+// openStorage 定义
+func (instance *GetBaiduMap) openStorage(jobPath string, para *DownloadParaStruct, polygons []PolygonStruct) (err error) {
+	metadata := &TileStorageMetadata{
+		Name:         fmt.Sprintf("%s %s", instance.provider.Name(), para.provinces),
+		Format:       instance.provider.Format(),
+		Scheme:       instance.provider.Scheme(),
+		MinZoomLevel: para.minZoomLevel,
+		MaxZoomLevel: para.maxZoomLevel,
+		Bounds:       polygonBounds(polygons, instance.provider.Datum()),
+		Dedupe:       para.dedupe,
+	}
+	instance.storage, err = OpenTileStorage(para.storage, jobPath, metadata)
+	if err != nil {
+		return
+	}
+	if mbtiles, ok := instance.storage.(*MBTilesStorage); ok && para.dedupe && !mbtiles.Dedupe() {
+		instance.putMessage("已有的MBTiles文件不是去重格式，瓦片按普通方式保存。")
+	}
+	// 只有更新任务需要与清单中的记录比较，其他任务只追加记录，不读入内存
+	instance.manifest, err = OpenTileManifest(jobPath, para.update)
+	if err != nil {
+		instance.storage.Close()
+	}
+	return
+}
 
-	rectAreas := instance.getDownloadingAreas(para.provinces)
+// closeStorage 定义
+func (instance *GetBaiduMap) closeStorage() {
+	if err := instance.storage.Close(); err != nil {
+		fmt.Println(err.Error())
+	}
+	if err := instance.manifest.Close(); err != nil {
+		fmt.Println(err.Error())
+	}
+}
 
-	instance.fetchMaps(jobPath, para.minZoomLevel, para.maxZoomLevel, rectAreas)
+// AbsJobPath 定义
+func AbsJobPath(jobPath string) (string, error) {
+	if !filepath.IsAbs(jobPath) {
+		relativePath, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		jobPath = filepath.Join(relativePath, jobPath)
+	}
+	return filepath.Clean(jobPath) + "/", nil
+}
+
+// checkJobPath 定义
+func checkJobPath(jobPath string) error {
+	info, err := os.Stat(jobPath)
+	if err != nil {
+		return fmt.Errorf("任务目录%s不存在", jobPath)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s不是目录", jobPath)
+	}
+	return nil
+}
+
+// confineJobPath 定义
+// 网页和接口提交的任务目录必须位于root之下，不能是root本身，按符号链接指向的实际路径判断。
+func confineJobPath(root string, jobPath string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realPath, err := filepath.EvalSymlinks(jobPath)
+	if err != nil {
+		return fmt.Errorf("任务目录%s不存在", jobPath)
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("任务目录%s不在%s之下", jobPath, root)
+	}
+	return nil
+}
+
+// execute 定义
+func (instance *GetBaiduMap) execute(jobPath string, para *DownloadParaStruct, polygons []PolygonStruct) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	instance.mu.Lock()
+	instance.cancelFunc = cancel
+	instance.mu.Unlock()
+	defer func() {
+		instance.mu.Lock()
+		instance.cancelFunc = nil
+		instance.mu.Unlock()
+		cancel()
+		instance.pause.Resume()
+	}()
+	go instance.putProcessingMessage()
+
+	firstDownloadTimes := instance.currentDownloadTimes
+	if instance.currentDownloadTimes == 0 {
+		instance.fetchMaps(ctx, jobPath, para.minZoomLevel, para.maxZoomLevel, polygons)
+	} else if instance.resuming {
+		instance.fetchErrorList(ctx, jobPath, instance.checkpoint.Snapshot().Total)
+	} else {
+		// 重试已完成任务中失败的文件
+		instance.fetchErrorList(ctx, jobPath, instance.checkpoint.Snapshot().ErrorCounter)
+	}
 
 	for {
-		if atomic.LoadUint64(&instance.jobStatus.errorCounter) == 0 {
+		if ctx.Err() != nil {
+			break
+		}
+		// 只剩永久性错误时不再重试
+		if atomic.LoadUint64(&instance.jobStatus.errorCounter) == atomic.LoadUint64(&instance.jobStatus.permanentCounter) {
 			break
 		}
-		instance.fetchErrorList(jobPath, atomic.LoadUint64(&instance.jobStatus.errorCounter))
+		if rounds := instance.currentDownloadTimes - firstDownloadTimes; instance.maxDownloadTimes > 0 && rounds >= instance.maxDownloadTimes {
+			instance.putMessage(fmt.Sprintf("已下载%d轮，仍有%d个文件下载失败，可通过retry命令继续下载。", rounds, atomic.LoadUint64(&instance.jobStatus.errorCounter)))
+			break
+		}
+		instance.fetchErrorList(ctx, jobPath, atomic.LoadUint64(&instance.jobStatus.errorCounter))
 	}
+
+	if ctx.Err() != nil {
+		msg := fmt.Sprintf("下载已取消，本轮%d个文件下载成功，已下载的文件保存在%s，可通过resume命令继续下载。", atomic.LoadUint64(&instance.jobStatus.counter), jobPath)
+		instance.putMessage(msg)
+		return errJobCancelled
+	}
+	instance.checkpoint.Finish()
+	instance.saveCheckpoint()
+	if instance.updating {
+		data := instance.checkpoint.Snapshot()
+		added, changed, unchanged := data.Added, data.Changed, data.Unchanged
+		instance.putMessage(fmt.Sprintf("更新完成：%d个文件内容有变化，%d个文件为新增，%d个文件没有变化。", changed, added, unchanged))
+	}
+	if linker, ok := instance.storage.(TileLinker); ok && (instance.dedupe || instance.emptyTilePolicy == EmptyTileDedupe) {
+		instance.putMessage(instance.dedupeMessage(linker))
+		instance.removeOrphans(linker)
+	}
+	return nil
 }
 
 // setDownloadFlag 定义
 func (instance *GetBaiduMap) setDownloadFlag(flg bool) {
+	instance.mu.Lock()
 	instance.downloadFlag = flg
+	instance.mu.Unlock()
+}
+
+// isDownloading 定义
+func (instance *GetBaiduMap) isDownloading() bool {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	return instance.downloadFlag
+}
+
+// setJobPath 定义
+func (instance *GetBaiduMap) setJobPath(jobPath string) {
+	instance.mu.Lock()
+	instance.jobPath = jobPath
+	instance.mu.Unlock()
+}
+
+// JobPath 定义
+func (instance *GetBaiduMap) JobPath() string {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	return instance.jobPath
+}
+
+// Progress 定义
+func (instance *GetBaiduMap) Progress() (downloadTimes int, counter, total, errorCounter uint64) {
+	downloadTimes = instance.currentDownloadTimes
+	counter = atomic.LoadUint64(&instance.jobStatus.counter)
+	total = atomic.LoadUint64(&instance.jobStatus.total)
+	errorCounter = atomic.LoadUint64(&instance.jobStatus.errorCounter)
+	return
 }
 
 // putMessage 定义
 func (instance *GetBaiduMap) putMessage(message string) {
-	if instance.broadcastMessageCallback != nil {
-		go instance.broadcastMessageCallback(message)
+	instance.putEvent(MessageTypeMessage, MessagePayload{EventText{message}})
+}
+
+// putEvent 定义
+func (instance *GetBaiduMap) putEvent(eventType string, payload interface{}) {
+	if instance.eventCallback == nil {
+		return
 	}
+	// 在当前goroutine中发送，保证消息的顺序
+	instance.eventCallback(&JobEvent{eventType, instance.jobID, payload})
+}
+
+// putRoundComplete 定义
+func (instance *GetBaiduMap) putRoundComplete() {
+	var payload RoundCompletePayload
+	payload.Round = instance.currentDownloadTimes
+	payload.Counter = atomic.LoadUint64(&instance.jobStatus.counter)
+	payload.Total = atomic.LoadUint64(&instance.jobStatus.total)
+	payload.ErrorCounter = atomic.LoadUint64(&instance.jobStatus.errorCounter)
+	payload.PermanentCounter = atomic.LoadUint64(&instance.jobStatus.permanentCounter)
+	payload.SkipCounter = atomic.LoadUint64(&instance.jobStatus.skipCounter)
+	payload.BlankCounter = atomic.LoadUint64(&instance.jobStatus.blankCounter)
+	payload.PlaceholderCount = atomic.LoadUint64(&instance.jobStatus.placeholderCounter)
+	payload.ErrorReasons = instance.errorList.SummaryCounts()
+	msg := fmt.Sprintf("第%d轮数据下载完成，共计%d个文件，%d个文件下载成功，%d个文件下载失败。", payload.Round, payload.Total, payload.Counter, payload.ErrorCounter)
+	payload.Text = msg + instance.skippedMessage() + instance.emptyTileMessage() + instance.errorSummaryMessage()
+	instance.putEvent(MessageTypeRoundComplete, payload)
 }
 
 // putProcessingMessage 定义
 func (instance *GetBaiduMap) putProcessingMessage() {
 	for {
-		if instance.downloadFlag == false {
+		if instance.isDownloading() == false {
 			break
 		}
-		if instance.jobStatus.counter > 0 {
-			msg := fmt.Sprintf("正在进行第%d轮数据下载，%d个文件下载成功，共计%d个文件，%d个文件下载失败。", instance.currentDownloadTimes+1, atomic.LoadUint64(&instance.jobStatus.counter), atomic.LoadUint64(&instance.jobStatus.total), atomic.LoadUint64(&instance.jobStatus.errorCounter))
-			instance.putMessage(msg)
-			time.Sleep(3 * time.Second)
+		if instance.pause.IsPaused() || atomic.LoadUint64(&instance.jobStatus.counter) == 0 {
+			time.Sleep(time.Second)
+			continue
 		}
+		var payload ProgressPayload
+		payload.Round = instance.currentDownloadTimes + 1
+		payload.Counter = atomic.LoadUint64(&instance.jobStatus.counter)
+		payload.Total = atomic.LoadUint64(&instance.jobStatus.total)
+		payload.ErrorCounter = atomic.LoadUint64(&instance.jobStatus.errorCounter)
+		payload.SkipCounter = atomic.LoadUint64(&instance.jobStatus.skipCounter)
+		msg := fmt.Sprintf("正在进行第%d轮数据下载，%d个文件下载成功，共计%d个文件，%d个文件下载失败。", payload.Round, payload.Counter, payload.Total, payload.ErrorCounter)
+		if instance.concurrency != nil {
+			payload.Concurrency = instance.concurrency.Limit()
+			msg += fmt.Sprintf("当前并发数%d。", payload.Concurrency)
+		}
+		payload.Text = msg + instance.skippedMessage()
+		instance.putEvent(MessageTypeProgress, payload)
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// errorSummaryMessage 定义
+func (instance *GetBaiduMap) errorSummaryMessage() string {
+	summary := instance.errorList.Summary()
+	if summary == "" {
+		return ""
+	}
+	msg := fmt.Sprintf("失败原因：%s。", summary)
+	if permanent := atomic.LoadUint64(&instance.jobStatus.permanentCounter); permanent > 0 {
+		msg += fmt.Sprintf("其中%d个文件不存在或为空白瓦片，不再重试。", permanent)
+	}
+	return msg
+}
+
+// dedupeMessage 定义
+// 按存储实际共用内容的结果统计本次保存的瓦片。
+func (instance *GetBaiduMap) dedupeMessage(linker TileLinker) string {
+	stats := linker.LinkStats()
+	if stats.Bytes == 0 {
+		return "去重保存：本次没有保存瓦片。"
+	}
+	msg := fmt.Sprintf("去重保存：本次保存%d个瓦片共%s，其中%d个与已有内容共用，节省%s（%.1f%%）。", stats.Tiles, formatBytes(stats.Bytes), stats.Shared, formatBytes(stats.SavedBytes), float64(stats.SavedBytes)*100/float64(stats.Bytes))
+	if stats.Copied > 0 {
+		msg += fmt.Sprintf("%d个瓦片无法共用内容（如不支持硬链接），单独保存。", stats.Copied)
+	}
+	return msg
+}
+
+// removeOrphans 定义
+// 瓦片更新后原来的内容可能不再被引用，任务完成时删除。
+func (instance *GetBaiduMap) removeOrphans(linker TileLinker) {
+	referenced, err := instance.manifest.Hashes()
+	if err != nil {
+		instance.putMessage(fmt.Sprintf("无法读取清单，未清理去重内容：%s", err.Error()))
+		return
+	}
+	count, size, err := linker.RemoveOrphans(referenced)
+	if err != nil {
+		instance.putMessage(fmt.Sprintf("清理去重内容失败：%s", err.Error()))
+	}
+	if count > 0 {
+		instance.putMessage(fmt.Sprintf("删除了%d个不再使用的去重内容，释放%s。", count, formatBytes(size)))
 	}
 }
 
-// Run 定义
-func (instance *GetBaiduMap) Run(message []byte) {
-	if instance.downloadFlag == true {
+// emptyTileMessage 定义
+func (instance *GetBaiduMap) emptyTileMessage() string {
+	blank := atomic.LoadUint64(&instance.jobStatus.blankCounter)
+	placeholder := atomic.LoadUint64(&instance.jobStatus.placeholderCounter)
+	if blank == 0 && placeholder == 0 {
+		return ""
+	}
+	actions := map[string]string{
+		EmptyTileStore:  "照常保存",
+		EmptyTileSkip:   "未保存",
+		EmptyTileDedupe: "只保存一份，其余引用同一文件",
+		EmptyTileError:  "记为下载失败",
+	}
+	return fmt.Sprintf("下载到%d个空白瓦片、%d个占位瓦片，%s。", blank, placeholder, actions[instance.emptyTilePolicy])
+}
+
+// skippedMessage 定义
+func (instance *GetBaiduMap) skippedMessage() string {
+	if skipped := atomic.LoadUint64(&instance.jobStatus.skipCounter); skipped > 0 {
+		return fmt.Sprintf("其中%d个文件已存在，未重新下载。", skipped)
+	}
+	return ""
+}
+
+// Cancel 定义
+func (instance *GetBaiduMap) Cancel() {
+	instance.mu.Lock()
+	cancel := instance.cancelFunc
+	instance.mu.Unlock()
+	if cancel == nil {
+		instance.putMessage("当前没有正在进行的下载任务。")
+		return
+	}
+	cancel()
+	instance.putMessage("正在取消下载任务……")
+}
+
+// Pause 定义
+func (instance *GetBaiduMap) Pause() {
+	if instance.isDownloading() == false {
+		instance.putMessage("当前没有正在进行的下载任务。")
 		return
 	}
-	go instance.download(message)
+	if instance.pause.Pause() {
+		instance.putMessage(fmt.Sprintf("下载已暂停，%d个文件下载成功。", atomic.LoadUint64(&instance.jobStatus.counter)))
+	}
+}
+
+// Resume 定义
+func (instance *GetBaiduMap) Resume() {
+	if instance.pause.Resume() {
+		instance.putMessage("下载已恢复。")
+	}
+}
+
+// IsPaused 定义
+func (instance *GetBaiduMap) IsPaused() bool {
+	return instance.pause.IsPaused()
 }
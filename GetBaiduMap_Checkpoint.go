@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointFileName     = "checkpoint.json"
+	checkpointVersion      = 1
+	checkpointSaveInterval = 2 * time.Second
+)
+
+// CheckpointStruct 定义
+// 断点文件内容，保存在任务目录下的checkpoint.json中。
+type CheckpointStruct struct {
+	Version               int
+	MinZoomLevel          int
+	MaxZoomLevel          int
+	Provinces             string
+	Provider              string
+	Storage               string
+	SkipExisting          bool
+	Update                bool
+	EmptyTilePolicy       string `json:",omitempty"`
+	Dedupe                bool   `json:",omitempty"`
+	ListCapacity          int
+	RectAreas             []CheckpointRectStruct `json:",omitempty"`
+	Polygons              [][][][2]float64
+	DownloadTimes         int
+	CompletedBatch        int64
+	Total                 uint64
+	Counter               uint64
+	ErrorCounter          uint64
+	PermanentErrorCounter uint64
+	Added                 uint64 `json:",omitempty"` // 更新任务中新增、有变化和没有变化的瓦片数，各轮累计
+	Changed               uint64 `json:",omitempty"`
+	Unchanged             uint64 `json:",omitempty"`
+	Finished              bool
+	UpdateTime            string
+}
+
+// CheckpointRectStruct 定义
+type CheckpointRectStruct struct {
+	Top, Bottom, Left, Right float64
+}
+
+// batchResult 定义
+type batchResult struct {
+	counter, errorCounter, permanentCounter uint64
+	added, changed, unchanged               uint64
+}
+
+// addUpdate 定义
+func (result *batchResult) addUpdate(update int) {
+	switch update {
+	case TileAdded:
+		result.added++
+	case TileChanged:
+		result.changed++
+	default:
+		result.unchanged++
+	}
+}
+
+// JobCheckpoint 定义
+// 各下载线程完成的批次可能乱序，只有从0开始连续完成的批次才计入CompletedBatch。
+type JobCheckpoint struct {
+	mu       sync.Mutex
+	fileName string
+	data     CheckpointStruct
+	finished map[int64]batchResult
+	lastSave time.Time
+}
+
+// NewJobCheckpoint 定义
+func NewJobCheckpoint(jobPath string, para *DownloadParaStruct, listCapacity int, polygons []PolygonStruct) *JobCheckpoint {
+	checkpoint := new(JobCheckpoint)
+	checkpoint.fileName = fmt.Sprintf("%s/%s", jobPath, checkpointFileName)
+	checkpoint.finished = make(map[int64]batchResult)
+	checkpoint.data.Version = checkpointVersion
+	checkpoint.data.MinZoomLevel = para.minZoomLevel
+	checkpoint.data.MaxZoomLevel = para.maxZoomLevel
+	checkpoint.data.Provinces = para.provinces
+	checkpoint.data.Provider = para.provider
+	checkpoint.data.Storage = para.storage
+	checkpoint.data.SkipExisting = para.skipExisting
+	checkpoint.data.Update = para.update
+	checkpoint.data.EmptyTilePolicy = para.emptyTilePolicy
+	checkpoint.data.Dedupe = para.dedupe
+	checkpoint.data.ListCapacity = listCapacity
+	checkpoint.data.Polygons = make([][][][2]float64, 0, len(polygons))
+	for _, polygon := range polygons {
+		checkpoint.data.Polygons = append(checkpoint.data.Polygons, polygon.rings)
+	}
+	return checkpoint
+}
+
+// LoadJobCheckpoint 定义
+func LoadJobCheckpoint(jobPath string) (checkpoint *JobCheckpoint, err error) {
+	fileName := fmt.Sprintf("%s/%s", jobPath, checkpointFileName)
+	jsonStr, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	checkpoint = new(JobCheckpoint)
+	checkpoint.fileName = fileName
+	checkpoint.finished = make(map[int64]batchResult)
+	err = json.Unmarshal(jsonStr, &checkpoint.data)
+	if err != nil {
+		checkpoint = nil
+		return
+	}
+	if checkpoint.data.Version != checkpointVersion {
+		err = fmt.Errorf("unsupported checkpoint version %d", checkpoint.data.Version)
+		checkpoint = nil
+	}
+	return
+}
+
+// Para 定义
+func (checkpoint *JobCheckpoint) Para() *DownloadParaStruct {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+	return &DownloadParaStruct{
+		minZoomLevel:    checkpoint.data.MinZoomLevel,
+		maxZoomLevel:    checkpoint.data.MaxZoomLevel,
+		provinces:       checkpoint.data.Provinces,
+		provider:        checkpoint.data.Provider,
+		storage:         checkpoint.data.Storage,
+		skipExisting:    checkpoint.data.SkipExisting,
+		update:          checkpoint.data.Update,
+		emptyTilePolicy: checkpoint.data.EmptyTilePolicy,
+		dedupe:          checkpoint.data.Dedupe,
+	}
+}
+
+// Polygons 定义
+// 早期的断点文件只保存了RectAreas，读取时转换为多边形。
+func (checkpoint *JobCheckpoint) Polygons() []PolygonStruct {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+	polygons := make([]PolygonStruct, 0, len(checkpoint.data.Polygons)+len(checkpoint.data.RectAreas))
+	for _, rings := range checkpoint.data.Polygons {
+		polygons = append(polygons, PolygonStruct{rings})
+	}
+	for _, rect := range checkpoint.data.RectAreas {
+		polygons = append(polygons, rectPolygon(RectAreaStruct{rect.Top, rect.Bottom, rect.Left, rect.Right}))
+	}
+	return polygons
+}
+
+// Snapshot 定义
+func (checkpoint *JobCheckpoint) Snapshot() CheckpointStruct {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+	return checkpoint.data
+}
+
+// StartRound 定义
+func (checkpoint *JobCheckpoint) StartRound(downloadTimes int, total uint64) {
+	checkpoint.mu.Lock()
+	checkpoint.data.DownloadTimes = downloadTimes
+	checkpoint.data.CompletedBatch = 0
+	checkpoint.data.Total = total
+	checkpoint.data.Counter = 0
+	checkpoint.data.ErrorCounter = 0
+	checkpoint.data.PermanentErrorCounter = 0
+	checkpoint.finished = make(map[int64]batchResult)
+	checkpoint.mu.Unlock()
+}
+
+// BatchDone 定义
+// 返回值表示CompletedBatch是否前进且距上次保存已超过保存间隔。
+func (checkpoint *JobCheckpoint) BatchDone(batch int64, result batchResult) bool {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+	checkpoint.finished[batch] = result
+	advanced := false
+	for {
+		result, ok := checkpoint.finished[checkpoint.data.CompletedBatch]
+		if !ok {
+			break
+		}
+		delete(checkpoint.finished, checkpoint.data.CompletedBatch)
+		checkpoint.data.Counter += result.counter
+		checkpoint.data.ErrorCounter += result.errorCounter
+		checkpoint.data.PermanentErrorCounter += result.permanentCounter
+		checkpoint.data.Added += result.added
+		checkpoint.data.Changed += result.changed
+		checkpoint.data.Unchanged += result.unchanged
+		checkpoint.data.CompletedBatch++
+		advanced = true
+	}
+	return advanced && time.Since(checkpoint.lastSave) >= checkpointSaveInterval
+}
+
+// Finish 定义
+func (checkpoint *JobCheckpoint) Finish() {
+	checkpoint.mu.Lock()
+	checkpoint.data.Finished = true
+	checkpoint.mu.Unlock()
+}
+
+// Reopen 定义
+// 重新下载已完成任务中失败的文件前调用。
+func (checkpoint *JobCheckpoint) Reopen() {
+	checkpoint.mu.Lock()
+	checkpoint.data.Finished = false
+	checkpoint.mu.Unlock()
+}
+
+// Save 定义
+func (checkpoint *JobCheckpoint) Save() (err error) {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+	checkpoint.data.UpdateTime = time.Now().Format("2006-01-02 15:04:05")
+	jsonStr, err := json.MarshalIndent(&checkpoint.data, "", "    ")
+	if err != nil {
+		return
+	}
+	tmpFileName := checkpoint.fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFileName, jsonStr, 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFileName, checkpoint.fileName)
+	checkpoint.lastSave = time.Now()
+	return
+}
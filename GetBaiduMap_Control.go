@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// PauseController 定义
+// 下载线程在处理每个瓦片前调用Wait，暂停期间阻塞，恢复或取消后返回。
+type PauseController struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+// NewPauseController 定义
+func NewPauseController() *PauseController {
+	return new(PauseController)
+}
+
+// Pause 定义
+func (pause *PauseController) Pause() bool {
+	pause.mu.Lock()
+	defer pause.mu.Unlock()
+	if pause.paused {
+		return false
+	}
+	pause.paused = true
+	pause.resume = make(chan struct{})
+	return true
+}
+
+// Resume 定义
+func (pause *PauseController) Resume() bool {
+	pause.mu.Lock()
+	defer pause.mu.Unlock()
+	if !pause.paused {
+		return false
+	}
+	pause.paused = false
+	close(pause.resume)
+	return true
+}
+
+// IsPaused 定义
+func (pause *PauseController) IsPaused() bool {
+	pause.mu.Lock()
+	defer pause.mu.Unlock()
+	return pause.paused
+}
+
+// Wait 定义
+func (pause *PauseController) Wait(ctx context.Context) error {
+	pause.mu.Lock()
+	if !pause.paused {
+		pause.mu.Unlock()
+		return ctx.Err()
+	}
+	resume := pause.resume
+	pause.mu.Unlock()
+
+	select {
+	case <-resume:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,35 +3,109 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// 错误列表每行一个JSON对象，Version为2；旧版本为每行若干个以制表符分隔的z,x,y。
+const errorListVersion = 2
+
+// TileErrorReasonLegacy 旧版错误列表没有记录失败原因
+const TileErrorReasonLegacy = "unknown"
+
+// TileErrorRecord 定义
+type TileErrorRecord struct {
+	Version    int
+	Z          int
+	X, Y       int64
+	Reason     string
+	StatusCode int `json:",omitempty"`
+	Attempts   int
+	Time       string
+	// Batch 记录所在的批次，从断点恢复时删除需要重新下载的批次的记录
+	Batch int64 `json:",omitempty"`
+}
+
+// newTileErrorRecord 定义
+func newTileErrorRecord(mapProperties *MapProperties, err error, attempts int) *TileErrorRecord {
+	record := &TileErrorRecord{
+		Version:  errorListVersion,
+		Z:        mapProperties.zoomLevel,
+		X:        mapProperties.x,
+		Y:        mapProperties.y,
+		Reason:   TileErrorNetwork,
+		Attempts: attempts,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+	var tileError *TileError
+	if errors.As(err, &tileError) {
+		record.Reason = tileError.Reason
+		record.StatusCode = tileError.StatusCode
+	}
+	return record
+}
+
+// MapProperties 定义
+func (record *TileErrorRecord) MapProperties() *MapProperties {
+	return &MapProperties{record.Z, record.X, record.Y}
+}
+
+// Permanent 定义
+func (record *TileErrorRecord) Permanent() bool {
+	return permanentReason(record.Reason, record.StatusCode)
+}
+
+// summaryKey 定义
+func (record *TileErrorRecord) summaryKey() string {
+	if record.Reason == TileErrorHTTPStatus {
+		return fmt.Sprintf("HTTP %d", record.StatusCode)
+	}
+	return record.Reason
+}
+
 // DownloadErrorInfo 定义
 type DownloadErrorInfo struct {
 	listCaption           int
 	writtingErrorFile     *os.File
 	writtingErrorFileName string
-	writtingErrorList     []*MapProperties
+	writtingErrorList     []*TileErrorRecord
 	readingErrorFile      *os.File
 	reader                *bufio.Reader
+	summary               map[string]uint64
 	mu                    sync.Mutex
 }
 
 // InitSave 定义
-func (errorMaps *DownloadErrorInfo) InitSave(downloadthreadCounter int, downloadPathName string) {
+// appendMode为true时从断点继续本轮，completedBatch及之后的批次会重新下载，先删除它们的记录，
+// 再按保留的记录恢复失败原因的统计。
+func (errorMaps *DownloadErrorInfo) InitSave(downloadthreadCounter int, downloadPathName string, appendMode bool, completedBatch int64) {
 	errorMaps.mu.Lock()
 	defer errorMaps.mu.Unlock()
-	errorMaps.writtingErrorList = make([]*MapProperties, 0, errorMaps.listCaption)
+	errorMaps.writtingErrorList = make([]*TileErrorRecord, 0, errorMaps.listCaption)
+	errorMaps.summary = make(map[string]uint64)
 	errorFileName := fmt.Sprintf("%s/errLst%d.err", downloadPathName, downloadthreadCounter)
 	errorMaps.writtingErrorFileName = errorFileName
+	if appendMode {
+		if err := truncateErrorList(errorFileName, completedBatch, errorMaps.summary); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
 	// errorMaps.writtingErrorFile = nil
 	// if errorMaps.writtingErrorFile == nil {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
 	var err error
-	errorMaps.writtingErrorFile, err = os.OpenFile(errorMaps.writtingErrorFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	errorMaps.writtingErrorFile, err = os.OpenFile(errorMaps.writtingErrorFileName, flag, 0777)
 	if err != nil {
 		fmt.Println(err.Error())
 		errorMaps.writtingErrorFile = nil
@@ -41,6 +115,52 @@ func (errorMaps *DownloadErrorInfo) InitSave(downloadthreadCounter int, download
 	// }
 }
 
+// truncateErrorList 定义
+// 只保留completedBatch之前的批次的记录，旧版本的记录没有批次，全部保留。
+// 保留的记录按失败原因计入summary。
+func truncateErrorList(fileName string, completedBatch int64, summary map[string]uint64) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "{") {
+			record := new(TileErrorRecord)
+			if json.Unmarshal([]byte(line), record) != nil {
+				buf.WriteString(line)
+			} else if record.Batch < completedBatch {
+				summary[record.summaryKey()]++
+				buf.WriteString(line)
+			}
+		} else if len(line) > 0 {
+			for _, value := range strings.Split(line, "\t") {
+				if strings.Count(value, ",") == 2 {
+					summary[TileErrorReasonLegacy]++
+				}
+			}
+			buf.WriteString(line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tmpFileName := fileName + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, buf.Bytes(), 0777); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
 // InitLoad 定义
 func (errorMaps *DownloadErrorInfo) InitLoad(downloadthreadCounter int, downloadPathName string) {
 	errorMaps.mu.Lock()
@@ -61,32 +181,74 @@ func (errorMaps *DownloadErrorInfo) saveLog() {
 	if errorMaps.writtingErrorList != nil && len(errorMaps.writtingErrorList) != 0 {
 
 		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
 		for _, value := range errorMaps.writtingErrorList {
-			message := fmt.Sprintf("%d,%d,%d\t", value.zoomLevel, value.x, value.y)
-			buf.WriteString(message)
+			encoder.Encode(value)
 		}
-		fmt.Fprintln(errorMaps.writtingErrorFile, buf.String())
+		errorMaps.writtingErrorFile.Write(buf.Bytes())
 	}
 }
 
 // Append 定义
-func (errorMaps *DownloadErrorInfo) Append(mapProperties []*MapProperties) {
+func (errorMaps *DownloadErrorInfo) Append(records []*TileErrorRecord) {
 	errorMaps.mu.Lock()
 	defer errorMaps.mu.Unlock()
 	if errorMaps.writtingErrorList == nil {
 		return
 	}
-	for _, value := range mapProperties {
+	for _, value := range records {
+		errorMaps.summary[value.summaryKey()]++
 		errorMaps.writtingErrorList = append(errorMaps.writtingErrorList, value)
 		if len(errorMaps.writtingErrorList) >= errorMaps.listCaption {
 			errorMaps.saveLog()
-			errorMaps.writtingErrorList = make([]*MapProperties, 0, errorMaps.listCaption)
+			errorMaps.writtingErrorList = make([]*TileErrorRecord, 0, errorMaps.listCaption)
 		}
 	}
 }
 
+// Flush 定义
+func (errorMaps *DownloadErrorInfo) Flush() {
+	errorMaps.mu.Lock()
+	defer errorMaps.mu.Unlock()
+	if errorMaps.writtingErrorList == nil {
+		return
+	}
+	errorMaps.saveLog()
+	errorMaps.writtingErrorList = make([]*TileErrorRecord, 0, errorMaps.listCaption)
+}
+
+// Summary 定义
+// 返回本轮失败原因的统计，例如“HTTP 404：12个，timeout：3个”。
+func (errorMaps *DownloadErrorInfo) Summary() string {
+	errorMaps.mu.Lock()
+	defer errorMaps.mu.Unlock()
+	keys := make([]string, 0, len(errorMaps.summary))
+	for key := range errorMaps.summary {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return errorMaps.summary[keys[i]] > errorMaps.summary[keys[j]] })
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, fmt.Sprintf("%s：%d个", key, errorMaps.summary[key]))
+	}
+	return strings.Join(items, "，")
+}
+
+// SummaryCounts 定义
+// 返回本轮各失败原因的数量。
+func (errorMaps *DownloadErrorInfo) SummaryCounts() map[string]uint64 {
+	errorMaps.mu.Lock()
+	defer errorMaps.mu.Unlock()
+	counts := make(map[string]uint64, len(errorMaps.summary))
+	for key, value := range errorMaps.summary {
+		counts[key] = value
+	}
+	return counts
+}
+
 // ReadLine 定义
-func (errorMaps *DownloadErrorInfo) ReadLine() (mapPropertiesList []*MapProperties) {
+// 读取一行错误记录，文件结束时返回nil。
+func (errorMaps *DownloadErrorInfo) ReadLine() (records []*TileErrorRecord) {
 	errorMaps.mu.Lock()
 	defer errorMaps.mu.Unlock()
 	if errorMaps.readingErrorFile == nil {
@@ -97,20 +259,28 @@ func (errorMaps *DownloadErrorInfo) ReadLine() (mapPropertiesList []*MapProperti
 	// _,err := fmt.Fscanf(errorMaps.readingErrorFile,"%s\n",&buf)
 	buf, err := errorMaps.reader.ReadString('\n')
 
-	if err == io.EOF {
+	if err == io.EOF && len(buf) == 0 {
 		return
-	} else if err != nil {
+	} else if err != nil && err != io.EOF {
 		fmt.Println(err.Error())
 	}
+	records = make([]*TileErrorRecord, 0, errorMaps.listCaption)
+	if strings.HasPrefix(strings.TrimSpace(buf), "{") {
+		record := new(TileErrorRecord)
+		if err = json.Unmarshal([]byte(buf), record); err == nil {
+			records = append(records, record)
+		} else {
+			fmt.Println(err.Error())
+		}
+		return
+	}
 	errorDatas := strings.Split(buf, "\t")
-	mapPropertiesList = make([]*MapProperties, 0, errorMaps.listCaption)
 	for _, value := range errorDatas {
 		var zoomLevel int
 		var x, y int64
 		_, err = fmt.Sscanf(value, "%d,%d,%d", &zoomLevel, &x, &y)
 		if err == nil {
-			mapProperties := &MapProperties{zoomLevel, x, y}
-			mapPropertiesList = append(mapPropertiesList, mapProperties)
+			records = append(records, &TileErrorRecord{Version: 1, Z: zoomLevel, X: x, Y: y, Reason: TileErrorReasonLegacy})
 		}
 	}
 	return
@@ -124,6 +294,7 @@ func (errorMaps *DownloadErrorInfo) CloseSave() {
 	errorMaps.writtingErrorFile.Close()
 	errorMaps.writtingErrorFileName = ""
 	errorMaps.writtingErrorFile = nil
+	errorMaps.writtingErrorList = nil
 }
 
 // CloseRead 定义
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestFileName = "manifest.txt"
+
+// 瓦片更新结果定义
+const (
+	TileAdded = iota
+	TileChanged
+	TileUnchanged
+)
+
+// ManifestEntry 定义
+type ManifestEntry struct {
+	UDT       string
+	Hash      [sha256.Size]byte
+	Size      int
+	FetchTime time.Time
+	// Skipped 按空白瓦片处理方式skip没有保存的瓦片
+	Skipped bool
+}
+
+// TileManifest 定义
+// 记录任务目录中每个瓦片的udt、SHA-256、大小和下载时间。
+// 文件每行一个瓦片：z,x,y\tudt\tsha256\tsize\tfetchTime，没有保存的空白瓦片行末另有\tskipped，
+// 同一瓦片以最后一行为准。只有load为true时才把全部记录读入内存，关闭时整理文件；
+// 否则只读入没有保存的瓦片，之后只追加记录。
+type TileManifest struct {
+	fileName string
+	entries  map[MapProperties]ManifestEntry
+	skipped  map[MapProperties]bool
+	file     *os.File
+	writer   *bufio.Writer
+	mu       sync.Mutex
+}
+
+// OpenTileManifest 定义
+func OpenTileManifest(jobPath string, load bool) (manifest *TileManifest, err error) {
+	manifest = new(TileManifest)
+	manifest.fileName = fmt.Sprintf("%s/%s", jobPath, manifestFileName)
+	manifest.skipped = make(map[MapProperties]bool)
+	if load {
+		manifest.entries = make(map[MapProperties]ManifestEntry)
+	}
+	err = readManifest(manifest.fileName, func(mapProperties MapProperties, entry ManifestEntry) {
+		if entry.Skipped {
+			manifest.skipped[mapProperties] = true
+		} else {
+			delete(manifest.skipped, mapProperties)
+		}
+		if load {
+			manifest.entries[mapProperties] = entry
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifest.file, err = os.OpenFile(manifest.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	manifest.writer = bufio.NewWriter(manifest.file)
+	return
+}
+
+// readManifest 定义
+// 按行读取清单文件，同一瓦片可能出现多次，后读到的为准。
+func readManifest(fileName string, fn func(mapProperties MapProperties, entry ManifestEntry)) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 && (len(fields) != 6 || fields[5] != "skipped") {
+			continue
+		}
+		var mapProperties MapProperties
+		if _, err := fmt.Sscanf(fields[0], "%d,%d,%d", &mapProperties.zoomLevel, &mapProperties.x, &mapProperties.y); err != nil {
+			continue
+		}
+		var entry ManifestEntry
+		entry.UDT = fields[1]
+		hash, err := hex.DecodeString(fields[2])
+		if err != nil || len(hash) != sha256.Size {
+			continue
+		}
+		copy(entry.Hash[:], hash)
+		if entry.Size, err = strconv.Atoi(fields[3]); err != nil {
+			continue
+		}
+		if entry.FetchTime, err = time.ParseInLocation("2006-01-02 15:04:05", fields[4], time.Local); err != nil {
+			continue
+		}
+		entry.Skipped = len(fields) == 6
+		fn(mapProperties, entry)
+	}
+	return scanner.Err()
+}
+
+// Get 定义
+// 只能在load为true时调用。
+func (manifest *TileManifest) Get(mapProperties *MapProperties) (entry ManifestEntry, ok bool) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	entry, ok = manifest.entries[*mapProperties]
+	return
+}
+
+// Compare 定义
+// 与清单中的记录比较，没有记录时与previous（已保存的瓦片）比较，返回瓦片是新增、有变化还是未变化。
+func (manifest *TileManifest) Compare(mapProperties *MapProperties, hash [sha256.Size]byte, previous []byte) int {
+	manifest.mu.Lock()
+	old, ok := manifest.entries[*mapProperties]
+	manifest.mu.Unlock()
+	switch {
+	case ok:
+		if old.Hash == hash {
+			return TileUnchanged
+		}
+		return TileChanged
+	case previous != nil:
+		if sha256.Sum256(previous) == hash {
+			return TileUnchanged
+		}
+		return TileChanged
+	}
+	return TileAdded
+}
+
+// Record 定义
+// udt为下载瓦片时请求的版本日期。
+func (manifest *TileManifest) Record(mapProperties *MapProperties, udt string, hash [sha256.Size]byte, size int) {
+	manifest.record(mapProperties, ManifestEntry{udt, hash, size, time.Now(), false})
+}
+
+// RecordSkipped 定义
+// 记录没有保存的空白或占位瓦片，继续下载时不再重新下载。
+func (manifest *TileManifest) RecordSkipped(mapProperties *MapProperties, udt string, hash [sha256.Size]byte, size int) {
+	manifest.record(mapProperties, ManifestEntry{udt, hash, size, time.Now(), true})
+}
+
+// Skipped 定义
+func (manifest *TileManifest) Skipped(mapProperties *MapProperties) bool {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	return manifest.skipped[*mapProperties]
+}
+
+// record 定义
+func (manifest *TileManifest) record(mapProperties *MapProperties, entry ManifestEntry) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if entry.Skipped {
+		manifest.skipped[*mapProperties] = true
+	} else {
+		delete(manifest.skipped, *mapProperties)
+	}
+	if manifest.entries != nil {
+		manifest.entries[*mapProperties] = entry
+	}
+	writeManifestEntry(manifest.writer, mapProperties, entry)
+}
+
+// Hashes 定义
+// 返回清单引用的瓦片内容。记录已读入内存时只包含每个瓦片的最新内容，
+// 否则包含文件中出现过的全部内容，被替换的旧内容也视为仍在使用。
+func (manifest *TileManifest) Hashes() (map[[sha256.Size]byte]bool, error) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	hashes := make(map[[sha256.Size]byte]bool)
+	if manifest.entries != nil {
+		for _, entry := range manifest.entries {
+			hashes[entry.Hash] = true
+		}
+		return hashes, nil
+	}
+	if err := manifest.writer.Flush(); err != nil {
+		return nil, err
+	}
+	err := readManifest(manifest.fileName, func(mapProperties MapProperties, entry ManifestEntry) {
+		hashes[entry.Hash] = true
+	})
+	return hashes, err
+}
+
+// Flush 定义
+func (manifest *TileManifest) Flush() error {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	return manifest.writer.Flush()
+}
+
+// Close 定义
+// 记录已读入内存时只保留每个瓦片的最新记录。
+func (manifest *TileManifest) Close() (err error) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if err = manifest.writer.Flush(); err != nil {
+		manifest.file.Close()
+		return
+	}
+	if err = manifest.file.Close(); err != nil || manifest.entries == nil {
+		return
+	}
+
+	tmpFileName := manifest.fileName + ".tmp"
+	file, err := os.Create(tmpFileName)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(file)
+	for mapProperties, entry := range manifest.entries {
+		writeManifestEntry(writer, &mapProperties, entry)
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmpFileName, manifest.fileName)
+}
+
+// writeManifestEntry 定义
+func writeManifestEntry(writer io.Writer, mapProperties *MapProperties, entry ManifestEntry) {
+	fmt.Fprintf(writer, "%d,%d,%d\t%s\t%s\t%d\t%s", mapProperties.zoomLevel, mapProperties.x, mapProperties.y, entry.UDT, hex.EncodeToString(entry.Hash[:]), entry.Size, entry.FetchTime.Format("2006-01-02 15:04:05"))
+	if entry.Skipped {
+		io.WriteString(writer, "\tskipped")
+	}
+	io.WriteString(writer, "\n")
+}
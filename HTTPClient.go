@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPClientConfigStruct 定义
+// 时间单位为秒。地图源中的HTTPClient只覆盖其中不为零的字段。
+type HTTPClientConfigStruct struct {
+	// ConnectTimeout 建立连接（含TLS握手）的超时时间
+	ConnectTimeout float64
+	// ReadTimeout 发出请求后等待响应头的超时时间
+	ReadTimeout float64
+	// Timeout 单个请求（含读取响应内容）的总超时时间
+	Timeout float64
+	// Proxy 代理地址，支持http://、https://和socks5://
+	Proxy               string
+	UserAgent           string
+	Referer             string
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     float64
+	KeepAlive           float64
+	DisableKeepAlives   *bool
+}
+
+// defaultHTTPClientConfig 定义
+var defaultHTTPClientConfig = HTTPClientConfigStruct{
+	ConnectTimeout:      10,
+	ReadTimeout:         30,
+	Timeout:             60,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90,
+	KeepAlive:           30,
+}
+
+// merge 定义
+func (base HTTPClientConfigStruct) merge(override *HTTPClientConfigStruct) HTTPClientConfigStruct {
+	if override == nil {
+		return base
+	}
+	if override.ConnectTimeout > 0 {
+		base.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.ReadTimeout > 0 {
+		base.ReadTimeout = override.ReadTimeout
+	}
+	if override.Timeout > 0 {
+		base.Timeout = override.Timeout
+	}
+	if override.Proxy != "" {
+		base.Proxy = override.Proxy
+	}
+	if override.UserAgent != "" {
+		base.UserAgent = override.UserAgent
+	}
+	if override.Referer != "" {
+		base.Referer = override.Referer
+	}
+	if override.MaxIdleConnsPerHost > 0 {
+		base.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.IdleConnTimeout > 0 {
+		base.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.KeepAlive > 0 {
+		base.KeepAlive = override.KeepAlive
+	}
+	if override.DisableKeepAlives != nil {
+		base.DisableKeepAlives = override.DisableKeepAlives
+	}
+	return base
+}
+
+// TileHTTPClient 定义
+// 同一地图源的所有下载线程共用一个TileHTTPClient，以复用连接。
+type TileHTTPClient struct {
+	client    *http.Client
+	userAgent string
+	referer   string
+}
+
+// NewTileHTTPClient 定义
+func NewTileHTTPClient(config HTTPClientConfigStruct) (*TileHTTPClient, error) {
+	seconds := func(value float64) time.Duration {
+		return time.Duration(value * float64(time.Second))
+	}
+	dialer := &net.Dialer{
+		Timeout:   seconds(config.ConnectTimeout),
+		KeepAlive: seconds(config.KeepAlive),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   seconds(config.ConnectTimeout),
+		ResponseHeaderTimeout: seconds(config.ReadTimeout),
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       seconds(config.IdleConnTimeout),
+	}
+	if config.DisableKeepAlives != nil {
+		transport.DisableKeepAlives = *config.DisableKeepAlives
+	}
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %s", config.Proxy, err.Error())
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	httpClient := new(TileHTTPClient)
+	httpClient.client = &http.Client{
+		Transport: transport,
+		Timeout:   seconds(config.Timeout),
+	}
+	httpClient.userAgent = config.UserAgent
+	httpClient.referer = config.Referer
+	return httpClient, nil
+}
+
+// Get 定义
+func (httpClient *TileHTTPClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient.userAgent != "" {
+		req.Header.Set("User-Agent", httpClient.userAgent)
+	}
+	if httpClient.referer != "" {
+		req.Header.Set("Referer", httpClient.referer)
+	}
+	return httpClient.client.Do(req)
+}
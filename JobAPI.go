@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JobAPI 定义
+// 提供任务的REST接口，请求和WebSocket提交的参数相同：
+//
+//	POST   /api/jobs       提交任务，Command为resume或update时按JobPath恢复或更新已有任务
+//	GET    /api/jobs       列出所有任务
+//	GET    /api/jobs/{id}  查询任务
+//	DELETE /api/jobs/{id}  取消任务
+//	GET    /api/jobs/{id}/events  任务已发送的事件，格式与WebSocket消息相同
+//	GET    /api/provinces  列出可下载的省份
+type JobAPI struct {
+	manager *JobManager
+	events  *EventLog
+}
+
+// ErrorResponseStruct 定义
+type ErrorResponseStruct struct {
+	Error string
+}
+
+// NewJobAPI 定义
+func NewJobAPI(manager *JobManager, events *EventLog) *JobAPI {
+	return &JobAPI{manager, events}
+}
+
+// ServeJobs 定义
+func (api *JobAPI) ServeJobs(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if name == "" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, 200, api.manager.List())
+		case "POST":
+			api.submit(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	resource := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, resource = name[:i], name[i+1:]
+	}
+	jobID, err := strconv.Atoi(name)
+	if err != nil || jobID <= 0 {
+		writeJSON(w, 404, ErrorResponseStruct{"任务" + name + "不存在"})
+		return
+	}
+	if resource != "" {
+		api.serveJobResource(w, r, jobID, resource)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		api.get(w, jobID, 200)
+	case "DELETE":
+		if _, ok := api.manager.Get(jobID); !ok {
+			api.get(w, jobID, 200)
+			return
+		}
+		if err = api.manager.Cancel(jobID); err != nil {
+			writeJSON(w, 409, ErrorResponseStruct{err.Error()})
+			return
+		}
+		api.get(w, jobID, 202)
+	default:
+		methodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+// serveJobResource 定义
+func (api *JobAPI) serveJobResource(w http.ResponseWriter, r *http.Request, jobID int, resource string) {
+	if resource != "events" || api.events == nil {
+		writeJSON(w, 404, ErrorResponseStruct{"Not found"})
+		return
+	}
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if _, ok := api.manager.Get(jobID); !ok {
+		writeJSON(w, 404, ErrorResponseStruct{"任务" + strconv.Itoa(jobID) + "不存在"})
+		return
+	}
+	writeJSON(w, 200, api.events.Events(jobID))
+}
+
+// ServeProvinces 定义
+func (api *JobAPI) ServeProvinces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	writeJSON(w, 200, api.manager.Provinces())
+}
+
+// submit 定义
+func (api *JobAPI) submit(w http.ResponseWriter, r *http.Request) {
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		writeJSON(w, 400, ErrorResponseStruct{err.Error()})
+		return
+	}
+	command, _, jobPath := api.manager.analyseCommand(message)
+	var jobID int
+	switch command {
+	case "":
+		var para *DownloadParaStruct
+		para, err = api.manager.analysePara(message)
+		if err == nil {
+			jobID, err = api.manager.Submit(para, nil)
+		}
+	case CommandResume:
+		jobID, err = api.manager.SubmitResume(jobPath, nil)
+	case CommandUpdate:
+		jobID, err = api.manager.SubmitUpdate(jobPath, nil)
+	default:
+		writeJSON(w, 400, ErrorResponseStruct{"不支持的命令" + command})
+		return
+	}
+	var inUse *JobPathInUseError
+	if errors.As(err, &inUse) {
+		writeJSON(w, 409, ErrorResponseStruct{err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 400, ErrorResponseStruct{err.Error()})
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+strconv.Itoa(jobID))
+	api.get(w, jobID, 201)
+}
+
+// get 定义
+func (api *JobAPI) get(w http.ResponseWriter, jobID int, statusCode int) {
+	info, ok := api.manager.Get(jobID)
+	if !ok {
+		writeJSON(w, 404, ErrorResponseStruct{"任务" + strconv.Itoa(jobID) + "不存在"})
+		return
+	}
+	writeJSON(w, statusCode, info)
+}
+
+// methodNotAllowed 定义
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, 405, ErrorResponseStruct{"Method not allowed"})
+}
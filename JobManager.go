@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 控制命令定义
+const (
+	CommandCancel    = "cancel"
+	CommandPause     = "pause"
+	CommandResume    = "resume"
+	CommandStatus    = "status"
+	CommandEstimate  = "estimate"
+	CommandUpdate    = "update"
+	CommandRateLimit = "ratelimit"
+)
+
+// 任务状态定义
+const (
+	JobStateQueued    = "queued"
+	JobStateRunning   = "running"
+	JobStatePaused    = "paused"
+	JobStateFinished  = "finished"
+	JobStateCancelled = "cancelled"
+	JobStateFailed    = "failed"
+)
+
+var jobStateNames = map[string]string{
+	JobStateQueued:    "排队中",
+	JobStateRunning:   "下载中",
+	JobStatePaused:    "已暂停",
+	JobStateFinished:  "已完成",
+	JobStateCancelled: "已取消",
+	JobStateFailed:    "失败",
+}
+
+const (
+	// maxFinishedJobs 保留的已结束任务数，超过时删除最早的任务
+	maxFinishedJobs = 100
+	// finishedJobRetention 已结束的任务保留的时间
+	finishedJobRetention = 24 * time.Hour
+)
+
+// DownloadJob 定义
+type DownloadJob struct {
+	ID         int
+	state      string
+	para       *DownloadParaStruct
+	resumePath string
+	downloader *GetBaiduMap
+	submitTime time.Time
+	startTime  time.Time
+	finishTime time.Time
+	err        error
+}
+
+// JobInfoStruct 定义
+type JobInfoStruct struct {
+	ID            int
+	State         string
+	Provider      string
+	Storage       string
+	Provinces     string
+	MinZoomLevel  int
+	MaxZoomLevel  int
+	JobPath       string
+	DownloadTimes int
+	Counter       uint64
+	Total         uint64
+	ErrorCounter  uint64
+	SubmitTime    string
+	StartTime     string
+	FinishTime    string
+	Error         string `json:",omitempty"`
+}
+
+// JobPathInUseError 定义
+type JobPathInUseError struct {
+	JobPath string
+	JobID   int
+}
+
+// Error 定义
+func (err *JobPathInUseError) Error() string {
+	return fmt.Sprintf("任务目录%s正在被任务%d使用", err.JobPath, err.JobID)
+}
+
+// ProvinceInfoJSONStruct 定义
+type ProvinceInfoJSONStruct struct {
+	Province  string
+	Longitude [2]float64
+	Latitude  [2]float64
+	Datum     string
+	// Polygon 是否配置了行政区边界，没有时按经纬度范围下载
+	Polygon bool
+}
+
+// JobManager 定义
+type JobManager struct {
+	config         *ConfigStruct
+	eventCallback  EventCallback
+	maxRunningJobs int
+	concurrency    *ConcurrencyController
+	statistics     *TileStatistics
+	metrics        *Metrics
+	rateLimiter    *RateLimiter
+	// jobRoot非空时提交的任务目录必须位于该目录之下
+	jobRoot string
+	// evictCallback 删除已结束的任务后调用，用于删除任务的事件记录
+	evictCallback func(jobID int)
+	jobs          map[int]*DownloadJob
+	order         []int
+	queue         []*DownloadJob
+	running       int
+	nextID        int
+	mu            sync.Mutex
+}
+
+// NewJobManager 定义
+func NewJobManager(config *ConfigStruct, eventCallback EventCallback) *JobManager {
+	manager := new(JobManager)
+	manager.config = config
+	manager.eventCallback = eventCallback
+	manager.maxRunningJobs = config.MaxRunningJobs
+	if manager.maxRunningJobs <= 0 {
+		manager.maxRunningJobs = 1
+	}
+	manager.concurrency = NewConcurrencyController(config.MinThreadCount, config.AllowedThreadCount)
+	manager.statistics = NewTileStatistics()
+	manager.metrics = NewMetrics()
+	manager.metrics.GaugeFunc("getmaps_queued_jobs", "排队等待的任务数", func() float64 {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		return float64(len(manager.queue))
+	})
+	manager.metrics.GaugeFunc("getmaps_running_jobs", "正在下载的任务数", func() float64 {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		return float64(manager.running)
+	})
+	manager.rateLimiter = NewRateLimiter(config.RateLimit)
+	manager.jobs = make(map[int]*DownloadJob)
+	manager.order = make([]int, 0, 100)
+	manager.queue = make([]*DownloadJob, 0, 100)
+	manager.nextID = 1
+	return manager
+}
+
+// analyseCommand 定义
+func (manager *JobManager) analyseCommand(message []byte) (command string, jobID int, jobPath string) {
+	var dat map[string]interface{}
+	if err := json.Unmarshal(message, &dat); err != nil {
+		return
+	}
+	command, _ = dat["Command"].(string)
+	command = strings.ToLower(command)
+	jobPath, _ = dat["JobPath"].(string)
+	switch value := dat["JobID"].(type) {
+	case float64:
+		jobID = int(value)
+	case string:
+		jobID, _ = strconv.Atoi(value)
+	}
+	return
+}
+
+// newJob 定义
+func (manager *JobManager) newJob() *DownloadJob {
+	job := new(DownloadJob)
+	job.ID = manager.nextID
+	manager.nextID++
+	job.state = JobStateQueued
+	job.submitTime = time.Now()
+	job.downloader = manager.newDownloader(manager.eventCallback)
+	job.downloader.jobID = job.ID
+	return job
+}
+
+// newDownloader 定义
+// 所有下载共用同一个并发控制、限速和瓦片统计。
+func (manager *JobManager) newDownloader(eventCallback EventCallback) *GetBaiduMap {
+	downloader := NewGetBaiduMap(manager.config, eventCallback)
+	downloader.concurrency = manager.concurrency
+	downloader.statistics = manager.statistics
+	downloader.metrics = manager.metrics
+	downloader.rateLimiter = manager.rateLimiter
+	return downloader
+}
+
+// Submit 定义
+// watcher不为nil时在任务加入队列前调用。
+func (manager *JobManager) Submit(para *DownloadParaStruct, watcher JobWatcher) (int, error) {
+	manager.mu.Lock()
+	if para.jobPath != "" {
+		if jobID, ok := manager.jobPathInUse(para.jobPath); ok {
+			manager.mu.Unlock()
+			return 0, &JobPathInUseError{para.jobPath, jobID}
+		}
+	}
+	job := manager.newJob()
+	job.para = para
+	manager.watch(job, watcher)
+	ahead := manager.enqueue(job)
+	manager.mu.Unlock()
+
+	manager.putJobMessage(job.ID, fmt.Sprintf("任务%d已加入队列（%s，%d-%d级），前面还有%d个排队任务。", job.ID, para.provinces, para.minZoomLevel, para.maxZoomLevel, ahead))
+	manager.schedule()
+	return job.ID, nil
+}
+
+// SubmitResume 定义
+func (manager *JobManager) SubmitResume(jobPath string, watcher JobWatcher) (int, error) {
+	absPath, err := AbsJobPath(jobPath)
+	if err != nil {
+		return 0, err
+	}
+	if err = manager.checkJobPath(absPath); err != nil {
+		return 0, err
+	}
+	checkpoint, err := LoadJobCheckpoint(absPath)
+	if err != nil {
+		return 0, fmt.Errorf("无法读取任务%s的断点信息：%s", absPath, err.Error())
+	}
+	manager.mu.Lock()
+	if jobID, ok := manager.jobPathInUse(absPath); ok {
+		manager.mu.Unlock()
+		return 0, &JobPathInUseError{absPath, jobID}
+	}
+	job := manager.newJob()
+	job.resumePath = absPath
+	job.para = checkpoint.Para()
+	manager.watch(job, watcher)
+	ahead := manager.enqueue(job)
+	manager.mu.Unlock()
+
+	manager.putJobMessage(job.ID, fmt.Sprintf("任务%d（从%s恢复）已加入队列，前面还有%d个排队任务。", job.ID, absPath, ahead))
+	manager.schedule()
+	return job.ID, nil
+}
+
+// SubmitUpdate 定义
+// 按断点文件中记录的参数和区域重新下载任务目录中的全部瓦片。
+func (manager *JobManager) SubmitUpdate(jobPath string, watcher JobWatcher) (int, error) {
+	absPath, err := AbsJobPath(jobPath)
+	if err != nil {
+		return 0, err
+	}
+	if err = manager.checkJobPath(absPath); err != nil {
+		return 0, err
+	}
+	checkpoint, err := LoadJobCheckpoint(absPath)
+	if err != nil {
+		return 0, fmt.Errorf("无法读取任务%s的断点信息：%s", absPath, err.Error())
+	}
+	para := checkpoint.Para()
+	para.jobPath = absPath
+	para.skipExisting = false
+	para.update = true
+	para.polygons = checkpoint.Polygons()
+	return manager.Submit(para, watcher)
+}
+
+// watch 定义
+// 调用者需持有manager.mu，任务还未开始，不会有事件先于订阅发出。
+func (manager *JobManager) watch(job *DownloadJob, watcher JobWatcher) {
+	if watcher != nil {
+		watcher(job.ID)
+	}
+}
+
+// jobPathInUse 定义
+// 调用者需持有manager.mu。
+func (manager *JobManager) jobPathInUse(absPath string) (int, bool) {
+	for _, job := range manager.jobs {
+		if !job.isActive() {
+			continue
+		}
+		if job.resumePath == absPath || job.downloader.JobPath() == absPath || (job.para != nil && job.para.jobPath == absPath) {
+			return job.ID, true
+		}
+	}
+	return 0, false
+}
+
+// JobPathActive 定义
+// 返回任务目录是否有排队或正在下载的任务。
+func (manager *JobManager) JobPathActive(absPath string) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	_, ok := manager.jobPathInUse(absPath)
+	return ok
+}
+
+// enqueue 定义
+func (manager *JobManager) enqueue(job *DownloadJob) (ahead int) {
+	ahead = len(manager.queue)
+	manager.jobs[job.ID] = job
+	manager.order = append(manager.order, job.ID)
+	manager.queue = append(manager.queue, job)
+	return
+}
+
+// schedule 定义
+func (manager *JobManager) schedule() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for manager.running < manager.maxRunningJobs && len(manager.queue) > 0 {
+		job := manager.queue[0]
+		manager.queue = manager.queue[1:]
+		job.state = JobStateRunning
+		job.startTime = time.Now()
+		manager.running++
+		go manager.runJob(job)
+	}
+}
+
+// runJob 定义
+func (manager *JobManager) runJob(job *DownloadJob) {
+	var err error
+	if job.resumePath != "" {
+		err = job.downloader.ResumeJob(job.resumePath)
+	} else {
+		err = job.downloader.Download(job.para)
+	}
+
+	manager.mu.Lock()
+	switch err {
+	case nil:
+		job.state = JobStateFinished
+	case errJobCancelled:
+		job.state = JobStateCancelled
+	default:
+		job.state = JobStateFailed
+		job.err = err
+	}
+	job.finishTime = time.Now()
+	manager.running--
+	info := job.info()
+	manager.mu.Unlock()
+
+	manager.putJobComplete(info)
+	manager.schedule()
+}
+
+// findJob 定义
+// 未指定任务编号时，如果只有一个未结束的任务则使用该任务。
+func (manager *JobManager) findJob(jobID int) (*DownloadJob, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if jobID > 0 {
+		job, ok := manager.jobs[jobID]
+		if !ok {
+			return nil, fmt.Errorf("任务%d不存在", jobID)
+		}
+		return job, nil
+	}
+	var found *DownloadJob
+	for _, job := range manager.jobs {
+		if job.isActive() {
+			if found != nil {
+				return nil, fmt.Errorf("存在多个任务，请指定任务编号")
+			}
+			found = job
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("当前没有正在进行的下载任务")
+	}
+	return found, nil
+}
+
+// Cancel 定义
+func (manager *JobManager) Cancel(jobID int) error {
+	job, err := manager.findJob(jobID)
+	if err != nil {
+		return err
+	}
+	manager.mu.Lock()
+	if job.state == JobStateQueued {
+		for index, value := range manager.queue {
+			if value == job {
+				manager.queue = append(manager.queue[:index], manager.queue[index+1:]...)
+				break
+			}
+		}
+		job.state = JobStateCancelled
+		job.finishTime = time.Now()
+		info := job.info()
+		manager.mu.Unlock()
+		manager.putJobComplete(info)
+		return nil
+	}
+	state := job.state
+	manager.mu.Unlock()
+	if state != JobStateRunning {
+		return fmt.Errorf("任务%d%s", job.ID, jobStateNames[state])
+	}
+	job.downloader.Cancel()
+	return nil
+}
+
+// Pause 定义
+func (manager *JobManager) Pause(jobID int) error {
+	job, err := manager.findJob(jobID)
+	if err != nil {
+		return err
+	}
+	manager.mu.Lock()
+	state := job.State()
+	manager.mu.Unlock()
+	if state != JobStateRunning {
+		return fmt.Errorf("任务%d%s", job.ID, jobStateNames[state])
+	}
+	job.downloader.Pause()
+	return nil
+}
+
+// Resume 定义
+func (manager *JobManager) Resume(jobID int) error {
+	job, err := manager.findJob(jobID)
+	if err != nil {
+		return err
+	}
+	manager.mu.Lock()
+	state := job.State()
+	manager.mu.Unlock()
+	if state != JobStatePaused {
+		return fmt.Errorf("任务%d%s", job.ID, jobStateNames[state])
+	}
+	job.downloader.Resume()
+	return nil
+}
+
+// List 定义
+func (manager *JobManager) List() []JobInfoStruct {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	infos := make([]JobInfoStruct, 0, len(manager.order))
+	for _, jobID := range manager.order {
+		infos = append(infos, manager.jobs[jobID].info())
+	}
+	return infos
+}
+
+// Get 定义
+func (manager *JobManager) Get(jobID int) (info JobInfoStruct, ok bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	job, ok := manager.jobs[jobID]
+	if ok {
+		info = job.info()
+	}
+	return
+}
+
+// Provinces 定义
+func (manager *JobManager) Provinces() []ProvinceInfoJSONStruct {
+	provinces := make([]ProvinceInfoJSONStruct, 0, len(manager.config.ProvinceInformation))
+	for _, value := range manager.config.ProvinceInformation {
+		provinces = append(provinces, ProvinceInfoJSONStruct{
+			Province:  value.province,
+			Longitude: value.area.longitude,
+			Latitude:  value.area.latitude,
+			Datum:     value.area.datum,
+			Polygon:   len(value.area.polygons) > 0,
+		})
+	}
+	return provinces
+}
+
+// StatusText 定义
+func (manager *JobManager) StatusText() string {
+	infos := manager.List()
+	if len(infos) == 0 {
+		return "当前没有任务。" + manager.rateLimiter.Config().String()
+	}
+	var buf bytes.Buffer
+	buf.WriteString(manager.rateLimiter.Config().String() + "\n")
+	for _, info := range infos {
+		buf.WriteString(fmt.Sprintf("任务%d：%s，%s，%d-%d级，第%d轮，%d/%d个文件，%d个失败。%s\n", info.ID, jobStateNames[info.State], info.Provinces, info.MinZoomLevel, info.MaxZoomLevel, info.DownloadTimes+1, info.Counter, info.Total, info.ErrorCounter, info.JobPath))
+	}
+	return buf.String()
+}
+
+// putMessage 定义
+func (manager *JobManager) putMessage(message string) {
+	manager.putJobMessage(0, message)
+}
+
+// putJobMessage 定义
+func (manager *JobManager) putJobMessage(jobID int, message string) {
+	manager.putEvent(textEvent(MessageTypeMessage, jobID, message))
+}
+
+// putJobComplete 定义
+func (manager *JobManager) putJobComplete(info JobInfoStruct) {
+	payload := JobCompletePayload{
+		State:        info.State,
+		JobPath:      info.JobPath,
+		Counter:      info.Counter,
+		Total:        info.Total,
+		ErrorCounter: info.ErrorCounter,
+		Error:        info.Error,
+	}
+	payload.Text = fmt.Sprintf("任务%d%s。", info.ID, jobStateNames[info.State])
+	manager.putEvent(&JobEvent{MessageTypeJobComplete, info.ID, payload})
+	manager.evictJobs()
+}
+
+// evictJobs 定义
+// 删除超过保留时间或超出保留数量的已结束任务，在任务结束时调用。
+func (manager *JobManager) evictJobs() {
+	manager.mu.Lock()
+	finished := 0
+	for _, jobID := range manager.order {
+		if !manager.jobs[jobID].isActive() {
+			finished++
+		}
+	}
+	order := make([]int, 0, len(manager.order))
+	evicted := make([]int, 0)
+	for _, jobID := range manager.order {
+		job := manager.jobs[jobID]
+		if !job.isActive() && (finished > maxFinishedJobs || time.Since(job.finishTime) > finishedJobRetention) {
+			finished--
+			delete(manager.jobs, jobID)
+			evicted = append(evicted, jobID)
+			continue
+		}
+		order = append(order, jobID)
+	}
+	manager.order = order
+	manager.mu.Unlock()
+
+	if manager.evictCallback != nil {
+		for _, jobID := range evicted {
+			manager.evictCallback(jobID)
+		}
+	}
+}
+
+// putEvent 定义
+func (manager *JobManager) putEvent(event *JobEvent) {
+	if manager.eventCallback != nil {
+		manager.eventCallback(event)
+	}
+}
+
+// HandleRequest 定义
+// 处理WebSocket客户端的消息，结果只回复给发送请求的连接。
+// 提交或恢复任务的连接自动订阅该任务。
+func (manager *JobManager) HandleRequest(request *Envelope, requester Requester) {
+	var jobID int
+	var text string
+	var err error
+	switch request.Type {
+	case MessageTypeSubmit:
+		var payload SubmitPayload
+		if err = request.DecodePayload(&payload); err == nil {
+			jobID, err = manager.submitPayload(&payload, requester.Watch)
+			text = fmt.Sprintf("任务%d已提交。", jobID)
+		}
+	case MessageTypeCommand:
+		var payload CommandPayload
+		if err = request.DecodePayload(&payload); err == nil {
+			jobID, text, err = manager.runCommand(request.JobID, &payload, requester.Watch)
+		}
+	case MessageTypeSubscribe, MessageTypeUnsubscribe:
+		var payload SubscribePayload
+		if err = request.DecodePayload(&payload); err == nil {
+			text, err = manager.subscribe(request.Type, payload.JobIDs, requester)
+		}
+	}
+	if err != nil {
+		requester.Reply(&JobEvent{MessageTypeRejected, request.JobID, RejectedPayload{EventText{err.Error()}, err.Error()}})
+		return
+	}
+	requester.Reply(&JobEvent{MessageTypeAccepted, jobID, AcceptedPayload{EventText{text}, jobID}})
+}
+
+// subscribe 定义
+// 只能订阅已存在的任务，取消订阅不检查任务是否存在。
+func (manager *JobManager) subscribe(requestType string, jobIDs []int, requester Requester) (string, error) {
+	if len(jobIDs) == 0 {
+		return "", fmt.Errorf("缺少jobIds")
+	}
+	names := make([]string, 0, len(jobIDs))
+	for _, jobID := range jobIDs {
+		names = append(names, strconv.Itoa(jobID))
+	}
+	if requestType == MessageTypeUnsubscribe {
+		for _, jobID := range jobIDs {
+			requester.Unwatch(jobID)
+		}
+		return fmt.Sprintf("已取消订阅任务%s。", strings.Join(names, "、")), nil
+	}
+	for _, jobID := range jobIDs {
+		if _, ok := manager.Get(jobID); !ok {
+			return "", fmt.Errorf("任务%d不存在", jobID)
+		}
+	}
+	for _, jobID := range jobIDs {
+		requester.Watch(jobID)
+	}
+	return fmt.Sprintf("已订阅任务%s。", strings.Join(names, "、")), nil
+}
+
+// submitPayload 定义
+func (manager *JobManager) submitPayload(payload *SubmitPayload, watcher JobWatcher) (int, error) {
+	message, err := payload.message()
+	if err != nil {
+		return 0, fmt.Errorf("提交参数错误：%s", err.Error())
+	}
+	para, err := manager.analysePara(message)
+	if err != nil {
+		return 0, err
+	}
+	return manager.Submit(para, watcher)
+}
+
+// runCommand 定义
+// 返回命令涉及的任务编号和回复给客户端的说明。
+func (manager *JobManager) runCommand(jobID int, payload *CommandPayload, watcher JobWatcher) (int, string, error) {
+	var err error
+	switch strings.ToLower(payload.Command) {
+	case CommandCancel:
+		err = manager.Cancel(jobID)
+		return jobID, "已发送取消命令。", err
+	case CommandPause:
+		err = manager.Pause(jobID)
+		return jobID, "已发送暂停命令。", err
+	case CommandResume:
+		if payload.JobPath != "" {
+			jobID, err = manager.SubmitResume(payload.JobPath, watcher)
+			return jobID, fmt.Sprintf("任务%d已提交。", jobID), err
+		}
+		err = manager.Resume(jobID)
+		return jobID, "已发送继续命令。", err
+	case CommandUpdate:
+		jobID, err = manager.SubmitUpdate(payload.JobPath, watcher)
+		return jobID, fmt.Sprintf("任务%d已提交。", jobID), err
+	case CommandRateLimit:
+		var config RateLimitConfigStruct
+		config, err = manager.SetRateLimit(payload.RequestsPerSecond, payload.RequestsPerSecondPerHost, payload.BytesPerSecond)
+		return 0, "已调整" + config.String(), err
+	case CommandStatus:
+		return 0, manager.StatusText(), nil
+	case CommandEstimate:
+		if payload.Para == nil {
+			return 0, "", fmt.Errorf("缺少para")
+		}
+		var message []byte
+		message, err = payload.Para.message()
+		if err != nil {
+			return 0, "", fmt.Errorf("提交参数错误：%s", err.Error())
+		}
+		var estimate EstimateStruct
+		estimate, err = manager.Estimate(message)
+		return 0, estimate.String(), err
+	}
+	return 0, "", fmt.Errorf("不支持的命令%s", payload.Command)
+}
+
+// SetRateLimit 定义
+// 为nil的限速项保持不变，立即对所有正在下载的任务生效。
+func (manager *JobManager) SetRateLimit(requestsPerSecond, requestsPerSecondPerHost, bytesPerSecond *float64) (RateLimitConfigStruct, error) {
+	config := manager.rateLimiter.Config()
+	fields := []struct {
+		name  string
+		value *float64
+		field *float64
+	}{
+		{"requestsPerSecond", requestsPerSecond, &config.RequestsPerSecond},
+		{"requestsPerSecondPerHost", requestsPerSecondPerHost, &config.RequestsPerSecondPerHost},
+		{"bytesPerSecond", bytesPerSecond, &config.BytesPerSecond},
+	}
+	for _, value := range fields {
+		if value.value == nil {
+			continue
+		}
+		if *value.value < 0 {
+			return config, fmt.Errorf("限速参数错误：%s不能小于0", value.name)
+		}
+		*value.field = *value.value
+	}
+	manager.rateLimiter.SetConfig(config)
+	manager.putMessage("已调整" + config.String())
+	return config, nil
+}
+
+// Estimate 定义
+func (manager *JobManager) Estimate(message []byte) (estimate EstimateStruct, err error) {
+	para, err := manager.analysePara(message)
+	if err != nil {
+		return
+	}
+	downloader := NewGetBaiduMap(manager.config, nil)
+	downloader.statistics = manager.statistics
+	estimate, err = downloader.Estimate(para)
+	return
+}
+
+// EstimateJSON 定义
+func (manager *JobManager) EstimateJSON(message []byte) (interface{}, error) {
+	return manager.Estimate(message)
+}
+
+// analysePara 定义
+func (manager *JobManager) analysePara(message []byte) (*DownloadParaStruct, error) {
+	para, err := analysePara(message)
+	if err != nil {
+		return nil, fmt.Errorf("提交参数错误：%s", err.Error())
+	}
+	if para.jobPath != "" {
+		if err = manager.checkJobPath(para.jobPath); err != nil {
+			return nil, fmt.Errorf("提交参数错误：%s", err.Error())
+		}
+		if err = mergeJobCheckpoint(para); err != nil {
+			return nil, fmt.Errorf("提交参数错误：%s", err.Error())
+		}
+	}
+	if para.provider == "" {
+		para.provider = DefaultTileProviderName
+	}
+	if para.storage == "" {
+		para.storage = StorageFile
+	}
+	provider, err := manager.config.TileProvider(para.provider)
+	if err != nil {
+		return nil, fmt.Errorf("提交参数错误：%s", err.Error())
+	}
+	if para.storage != StorageFile && para.storage != StorageMBTiles {
+		return nil, fmt.Errorf("提交参数错误：unknown storage %s", para.storage)
+	}
+	if para.minZoomLevel < 0 || para.minZoomLevel > para.maxZoomLevel {
+		return nil, fmt.Errorf("提交参数错误：层级范围%d-%d无效", para.minZoomLevel, para.maxZoomLevel)
+	}
+	if para.maxZoomLevel > provider.MaxZoom() {
+		return nil, fmt.Errorf("提交参数错误：地图源%s的最大层级为%d", para.provider, provider.MaxZoom())
+	}
+	if para.provinces == "" && len(para.areas) == 0 {
+		return nil, fmt.Errorf("提交参数错误：没有选择要下载的区域")
+	}
+	return para, nil
+}
+
+// checkJobPath 定义
+func (manager *JobManager) checkJobPath(absPath string) error {
+	if err := checkJobPath(absPath); err != nil {
+		return err
+	}
+	if manager.jobRoot != "" {
+		return confineJobPath(manager.jobRoot, absPath)
+	}
+	return nil
+}
+
+// State 定义
+func (job *DownloadJob) State() string {
+	if job.state == JobStateRunning && job.downloader.IsPaused() {
+		return JobStatePaused
+	}
+	return job.state
+}
+
+// isActive 定义
+func (job *DownloadJob) isActive() bool {
+	return job.state == JobStateQueued || job.state == JobStateRunning
+}
+
+// info 定义
+func (job *DownloadJob) info() (info JobInfoStruct) {
+	info.ID = job.ID
+	info.State = job.State()
+	if job.para != nil {
+		info.Provider = job.para.provider
+		info.Storage = job.para.storage
+		info.Provinces = job.para.provinces
+		info.MinZoomLevel = job.para.minZoomLevel
+		info.MaxZoomLevel = job.para.maxZoomLevel
+	}
+	info.JobPath = job.downloader.JobPath()
+	if info.JobPath == "" {
+		info.JobPath = job.resumePath
+	}
+	if job.state != JobStateQueued {
+		info.DownloadTimes, info.Counter, info.Total, info.ErrorCounter = job.downloader.Progress()
+	}
+	info.SubmitTime = formatJobTime(job.submitTime)
+	info.StartTime = formatJobTime(job.startTime)
+	info.FinishTime = formatJobTime(job.finishTime)
+	if job.err != nil {
+		info.Error = job.err.Error()
+	}
+	return
+}
+
+// formatJobTime 定义
+func formatJobTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
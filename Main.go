@@ -1,14 +1,13 @@
 package main
 
 import (
+	"os"
 )
 
 func main() {
-    config := NewConfig()
-    
-    webSocketService := NewWebSocketService("web","home.html",config.Port)
-    getBaiduMap := NewGetBaiduMap(config,webSocketService.BroadcastMessage)
-    webSocketService.submitCallback = getBaiduMap.Run
-    
-    webSocketService.Start()
-}
\ No newline at end of file
+	config := NewConfig()
+	if config == nil {
+		os.Exit(ExitError)
+	}
+	os.Exit(RunCommand(config, os.Args[1:]))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 请求耗时直方图的分桶上限（秒）
+var requestDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// tileMetricKey 定义
+type tileMetricKey struct {
+	provider string
+	zoom     int
+	reason   string
+}
+
+// durationHistogram 定义
+type durationHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// gaugeFunc 定义
+// 在输出时取值的指标，如排队的任务数。
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+// Metrics 定义
+// 记录所有任务的下载统计，以Prometheus文本格式从/metrics输出。
+// 方法可以在nil上调用，命令行模式的估算等不需要统计的下载器不设置metrics。
+type Metrics struct {
+	mu            sync.Mutex
+	fetched       map[tileMetricKey]uint64
+	failed        map[tileMetricKey]uint64
+	skipped       map[tileMetricKey]uint64
+	bytes         map[string]uint64
+	rounds        map[string]uint64
+	retryRounds   map[string]uint64
+	durations     map[string]*durationHistogram
+	gauges        []gaugeFunc
+	activeWorkers int64
+}
+
+// NewMetrics 定义
+func NewMetrics() *Metrics {
+	return &Metrics{
+		fetched:     make(map[tileMetricKey]uint64),
+		failed:      make(map[tileMetricKey]uint64),
+		skipped:     make(map[tileMetricKey]uint64),
+		bytes:       make(map[string]uint64),
+		rounds:      make(map[string]uint64),
+		retryRounds: make(map[string]uint64),
+		durations:   make(map[string]*durationHistogram),
+	}
+}
+
+// TileFetched 定义
+func (metrics *Metrics) TileFetched(provider string, zoom int) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	metrics.fetched[tileMetricKey{provider, zoom, ""}]++
+	metrics.mu.Unlock()
+}
+
+// TileSkipped 定义
+// 已保存的瓦片没有重新下载。
+func (metrics *Metrics) TileSkipped(provider string, zoom int) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	metrics.skipped[tileMetricKey{provider, zoom, ""}]++
+	metrics.mu.Unlock()
+}
+
+// TileFailed 定义
+func (metrics *Metrics) TileFailed(provider string, zoom int, reason string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	metrics.failed[tileMetricKey{provider, zoom, reason}]++
+	metrics.mu.Unlock()
+}
+
+// AddBytes 定义
+func (metrics *Metrics) AddBytes(provider string, size int) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	metrics.bytes[provider] += uint64(size)
+	metrics.mu.Unlock()
+}
+
+// ObserveRequest 定义
+// 记录向瓦片服务器请求一个瓦片的耗时，不含限速等待。
+func (metrics *Metrics) ObserveRequest(host string, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	seconds := duration.Seconds()
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	histogram, ok := metrics.durations[host]
+	if !ok {
+		histogram = &durationHistogram{buckets: make([]uint64, len(requestDurationBuckets))}
+		metrics.durations[host] = histogram
+	}
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// RoundStarted 定义
+func (metrics *Metrics) RoundStarted(provider string, retry bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	metrics.rounds[provider]++
+	if retry {
+		metrics.retryRounds[provider]++
+	}
+	metrics.mu.Unlock()
+}
+
+// WorkerStarted 定义
+func (metrics *Metrics) WorkerStarted() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.activeWorkers, 1)
+	}
+}
+
+// WorkerStopped 定义
+func (metrics *Metrics) WorkerStopped() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.activeWorkers, -1)
+	}
+}
+
+// GaugeFunc 定义
+// 注册在输出时取值的指标。
+func (metrics *Metrics) GaugeFunc(name, help string, value func() float64) {
+	metrics.mu.Lock()
+	metrics.gauges = append(metrics.gauges, gaugeFunc{name, help, value})
+	metrics.mu.Unlock()
+}
+
+// ServeHTTP 定义
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// write 定义
+func (metrics *Metrics) write(w io.Writer) {
+	metrics.mu.Lock()
+	writeTileCounters(w, "getmaps_tiles_fetched_total", "下载成功的瓦片数", metrics.fetched, false)
+	writeTileCounters(w, "getmaps_tiles_failed_total", "下载失败的瓦片数", metrics.failed, true)
+	writeTileCounters(w, "getmaps_tiles_skipped_total", "已保存而跳过的瓦片数", metrics.skipped, false)
+	writeProviderCounters(w, "getmaps_downloaded_bytes_total", "从瓦片服务器下载的字节数", metrics.bytes)
+	writeProviderCounters(w, "getmaps_download_rounds_total", "开始的下载轮数", metrics.rounds)
+	writeProviderCounters(w, "getmaps_retry_rounds_total", "开始的重试轮数（第2轮及以后）", metrics.retryRounds)
+	writeDurations(w, metrics.durations)
+	gauges := metrics.gauges
+	metrics.mu.Unlock()
+
+	writeMetricHeader(w, "getmaps_active_workers", "正在运行的下载线程数", "gauge")
+	fmt.Fprintf(w, "getmaps_active_workers %d\n", atomic.LoadInt64(&metrics.activeWorkers))
+	// 取值函数可能需要其他锁，不在metrics.mu中调用
+	for _, gauge := range gauges {
+		writeMetricHeader(w, gauge.name, gauge.help, "gauge")
+		fmt.Fprintf(w, "%s %g\n", gauge.name, gauge.value())
+	}
+}
+
+// writeMetricHeader 定义
+func writeMetricHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeTileCounters 定义
+func writeTileCounters(w io.Writer, name, help string, counters map[tileMetricKey]uint64, withReason bool) {
+	writeMetricHeader(w, name, help, "counter")
+	keys := make([]tileMetricKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].provider != keys[j].provider {
+			return keys[i].provider < keys[j].provider
+		}
+		if keys[i].zoom != keys[j].zoom {
+			return keys[i].zoom < keys[j].zoom
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	for _, key := range keys {
+		labels := fmt.Sprintf(`provider="%s",zoom="%d"`, escapeLabel(key.provider), key.zoom)
+		if withReason {
+			labels += fmt.Sprintf(`,reason="%s"`, escapeLabel(key.reason))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, counters[key])
+	}
+}
+
+// writeProviderCounters 定义
+func writeProviderCounters(w io.Writer, name, help string, counters map[string]uint64) {
+	writeMetricHeader(w, name, help, "counter")
+	for _, provider := range sortedKeys(counters) {
+		fmt.Fprintf(w, "%s{provider=\"%s\"} %d\n", name, escapeLabel(provider), counters[provider])
+	}
+}
+
+// writeDurations 定义
+func writeDurations(w io.Writer, durations map[string]*durationHistogram) {
+	const name = "getmaps_request_duration_seconds"
+	writeMetricHeader(w, name, "按瓦片服务器统计的请求耗时", "histogram")
+	hosts := make([]string, 0, len(durations))
+	for host := range durations {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		histogram := durations[host]
+		label := escapeLabel(host)
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket{host=\"%s\",le=\"%g\"} %d\n", name, label, bound, histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{host=\"%s\",le=\"+Inf\"} %d\n", name, label, histogram.count)
+		fmt.Fprintf(w, "%s_sum{host=\"%s\"} %g\n", name, label, histogram.sum)
+		fmt.Fprintf(w, "%s_count{host=\"%s\"} %d\n", name, label, histogram.count)
+	}
+}
+
+// sortedKeys 定义
+func sortedKeys(counters map[string]uint64) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper 按Prometheus文本格式转义标签值
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel 定义
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
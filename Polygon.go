@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// PolygonStruct 定义
+// rings中第一个环为外边界，其余为内部的洞，坐标为[经度, 纬度]。
+type PolygonStruct struct {
+	rings [][][2]float64
+}
+
+// geoJSONStruct 定义
+type geoJSONStruct struct {
+	Type        string
+	Coordinates json.RawMessage
+	Geometry    *geoJSONStruct
+	Features    []geoJSONStruct
+	Geometries  []geoJSONStruct
+}
+
+// ParseGeoJSON 定义
+// 支持Polygon、MultiPolygon、GeometryCollection、Feature和FeatureCollection。
+func ParseGeoJSON(data []byte) (polygons []PolygonStruct, err error) {
+	var object geoJSONStruct
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return
+	}
+	polygons, err = object.polygons()
+	if err == nil && len(polygons) == 0 {
+		err = fmt.Errorf("geojson contains no polygon")
+	}
+	return
+}
+
+// polygons 定义
+func (object *geoJSONStruct) polygons() (polygons []PolygonStruct, err error) {
+	switch object.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		if err = json.Unmarshal(object.Coordinates, &rings); err != nil {
+			return
+		}
+		polygons = appendPolygon(polygons, rings)
+	case "MultiPolygon":
+		var multiRings [][][][2]float64
+		if err = json.Unmarshal(object.Coordinates, &multiRings); err != nil {
+			return
+		}
+		for _, rings := range multiRings {
+			polygons = appendPolygon(polygons, rings)
+		}
+	case "Feature":
+		if object.Geometry != nil {
+			polygons, err = object.Geometry.polygons()
+		}
+	case "FeatureCollection", "GeometryCollection":
+		children := object.Features
+		if object.Type == "GeometryCollection" {
+			children = object.Geometries
+		}
+		for index := range children {
+			var childPolygons []PolygonStruct
+			childPolygons, err = children[index].polygons()
+			if err != nil {
+				return
+			}
+			polygons = append(polygons, childPolygons...)
+		}
+	default:
+		err = fmt.Errorf("unsupported geojson type %s", object.Type)
+	}
+	return
+}
+
+// appendPolygon 定义
+func appendPolygon(polygons []PolygonStruct, rings [][][2]float64) []PolygonStruct {
+	if len(rings) == 0 || len(rings[0]) < 3 {
+		return polygons
+	}
+	return append(polygons, PolygonStruct{rings})
+}
+
+// rectPolygon 定义
+func rectPolygon(rect RectAreaStruct) PolygonStruct {
+	return PolygonStruct{[][][2]float64{{
+		{rect.left, rect.top}, {rect.right, rect.top}, {rect.right, rect.bottom}, {rect.left, rect.bottom}, {rect.left, rect.top},
+	}}}
+}
+
+// convertPolygon 定义
+func convertPolygon(polygon PolygonStruct, from string, to string) PolygonStruct {
+	if from == to {
+		return polygon
+	}
+	rings := make([][][2]float64, 0, len(polygon.rings))
+	for _, ring := range polygon.rings {
+		converted := make([][2]float64, 0, len(ring))
+		for _, point := range ring {
+			lng, lat := ConvertDatum(point[0], point[1], from, to)
+			converted = append(converted, [2]float64{lng, lat})
+		}
+		rings = append(rings, converted)
+	}
+	return PolygonStruct{rings}
+}
+
+// polygonEdge 定义
+type polygonEdge struct {
+	polygon        int
+	x1, y1, x2, y2 float64
+	minY, maxY     float64
+}
+
+// edgeCrossing 定义
+type edgeCrossing struct {
+	polygon int
+	x       float64
+}
+
+// tileInterval 定义
+type tileInterval struct {
+	start, end int64
+}
+
+// EnumeratePolygonTiles 定义
+// 使用扫描线逐行求出与多边形相交的瓦片，多个多边形重叠的瓦片只输出一次；
+// fn返回false时停止枚举并返回false。
+func EnumeratePolygonTiles(scheme string, zoomLevel int, polygons []PolygonStruct, fn func(x, y int64) bool) bool {
+	return enumeratePolygonRows(scheme, zoomLevel, polygons, func(row int64, intervals []tileInterval) bool {
+		for _, interval := range intervals {
+			for x := interval.start; x <= interval.end; x++ {
+				if !fn(x, row) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// CountPolygonTiles 定义
+// 与EnumeratePolygonTiles相同的瓦片数，按行累加区间长度，不逐个枚举瓦片。
+func CountPolygonTiles(scheme string, zoomLevel int, polygons []PolygonStruct) uint64 {
+	counter := uint64(0)
+	enumeratePolygonRows(scheme, zoomLevel, polygons, func(row int64, intervals []tileInterval) bool {
+		for _, interval := range intervals {
+			counter += uint64(interval.end - interval.start + 1)
+		}
+		return true
+	})
+	return counter
+}
+
+// enumeratePolygonRows 定义
+// 逐行输出与多边形相交的瓦片区间，区间已合并且按x排序；fn返回false时停止并返回false。
+func enumeratePolygonRows(scheme string, zoomLevel int, polygons []PolygonStruct, fn func(row int64, intervals []tileInterval) bool) bool {
+	edges := make([]polygonEdge, 0, 1024)
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for index, polygon := range polygons {
+		for _, ring := range polygon.rings {
+			for i := 0; i+1 < len(ring); i++ {
+				x1, y1 := projectToTile(scheme, zoomLevel, ring[i][0], ring[i][1])
+				x2, y2 := projectToTile(scheme, zoomLevel, ring[i+1][0], ring[i+1][1])
+				edges = append(edges, polygonEdge{index, x1, y1, x2, y2, math.Min(y1, y2), math.Max(y1, y2)})
+				minY = math.Min(minY, math.Min(y1, y2))
+				maxY = math.Max(maxY, math.Max(y1, y2))
+			}
+			// 未闭合的环补上最后一条边
+			last := len(ring) - 1
+			if last > 0 && ring[0] != ring[last] {
+				x1, y1 := projectToTile(scheme, zoomLevel, ring[last][0], ring[last][1])
+				x2, y2 := projectToTile(scheme, zoomLevel, ring[0][0], ring[0][1])
+				edges = append(edges, polygonEdge{index, x1, y1, x2, y2, math.Min(y1, y2), math.Max(y1, y2)})
+			}
+		}
+	}
+	if len(edges) == 0 {
+		return true
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].minY < edges[j].minY })
+
+	active := make([]polygonEdge, 0, 64)
+	next := 0
+	for row := int64(math.Floor(minY)); row <= int64(math.Floor(maxY)); row++ {
+		bandTop, bandBottom := float64(row), float64(row+1)
+		for next < len(edges) && edges[next].minY <= bandBottom {
+			active = append(active, edges[next])
+			next++
+		}
+		kept := active[:0]
+		for _, edge := range active {
+			if edge.maxY >= bandTop {
+				kept = append(kept, edge)
+			}
+		}
+		active = kept
+
+		intervals := make([]tileInterval, 0, 16)
+		// 边界经过的瓦片
+		for _, edge := range active {
+			if edge.maxY < bandTop || edge.minY > bandBottom {
+				continue
+			}
+			xa, xb := clipEdgeToBand(edge, bandTop, bandBottom)
+			intervals = append(intervals, cellInterval(xa, xb))
+		}
+		// 完全位于多边形内部的瓦片，取行中线对每个多边形分别按奇偶规则求交
+		center := float64(row) + 0.5
+		crossings := make([]edgeCrossing, 0, 16)
+		for _, edge := range active {
+			if (edge.y1 <= center && center < edge.y2) || (edge.y2 <= center && center < edge.y1) {
+				crossings = append(crossings, edgeCrossing{edge.polygon, edge.x1 + (center-edge.y1)*(edge.x2-edge.x1)/(edge.y2-edge.y1)})
+			}
+		}
+		sort.Slice(crossings, func(i, j int) bool {
+			if crossings[i].polygon != crossings[j].polygon {
+				return crossings[i].polygon < crossings[j].polygon
+			}
+			return crossings[i].x < crossings[j].x
+		})
+		for i := 0; i+1 < len(crossings); i += 2 {
+			if crossings[i].polygon != crossings[i+1].polygon {
+				i--
+				continue
+			}
+			intervals = append(intervals, cellInterval(crossings[i].x, crossings[i+1].x))
+		}
+
+		if !fn(row, mergeTileIntervals(intervals)) {
+			return false
+		}
+	}
+	return true
+}
+
+// clipEdgeToBand 定义
+func clipEdgeToBand(edge polygonEdge, bandTop float64, bandBottom float64) (float64, float64) {
+	if edge.y1 == edge.y2 {
+		return math.Min(edge.x1, edge.x2), math.Max(edge.x1, edge.x2)
+	}
+	xAt := func(y float64) float64 {
+		return edge.x1 + (y-edge.y1)*(edge.x2-edge.x1)/(edge.y2-edge.y1)
+	}
+	lowY := math.Max(edge.minY, bandTop)
+	highY := math.Min(edge.maxY, bandBottom)
+	xa, xb := xAt(lowY), xAt(highY)
+	return math.Min(xa, xb), math.Max(xa, xb)
+}
+
+// cellInterval 定义
+func cellInterval(xa float64, xb float64) tileInterval {
+	start := int64(math.Floor(xa))
+	end := int64(math.Ceil(xb)) - 1
+	if end < start {
+		end = start
+	}
+	return tileInterval{start, end}
+}
+
+// mergeTileIntervals 定义
+func mergeTileIntervals(intervals []tileInterval) []tileInterval {
+	if len(intervals) == 0 {
+		return intervals
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start < intervals[j].start })
+	merged := intervals[:1]
+	for _, interval := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if interval.start <= last.end+1 {
+			if interval.end > last.end {
+				last.end = interval.end
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+)
+
+// 百度墨卡托投影（BD09MC）分段多项式参数，按纬度（或墨卡托纵坐标）分带。
+var (
+	mcBand = []float64{12890594.86, 8362377.87, 5591021, 3481989.83, 1678043.12, 0}
+	llBand = []float64{75, 60, 45, 30, 15, 0}
+
+	mc2ll = [][]float64{
+		{1.410526172116255e-8, 0.00000898305509648872, -1.9939833816331, 200.9824383106796, -187.2403703815547, 91.6087516669843, -23.38765649603339, 2.57121317296198, -0.03801003308653, 17337981.2},
+		{-7.435856389565537e-9, 0.000008983055097726239, -0.78625201886289, 96.32687599759846, -1.85204757529826, -59.36935905485877, 47.40033549296737, -16.50741931063887, 2.28786674699375, 10260144.86},
+		{-3.030883460898826e-8, 0.00000898305509983578, 0.30071316287616, 59.74293618442277, 7.357984074871, -25.38371002664745, 13.45380521110908, -3.29883767235584, 0.32710905363475, 6856817.37},
+		{-1.981981304930552e-8, 0.000008983055099779535, 0.03278182852591, 40.31678527705744, 0.65659298677277, -4.44255534477492, 0.85341911805263, 0.12923347998204, -0.04625736007561, 4482777.06},
+		{3.09191371068437e-9, 0.000008983055096812155, 0.00006995724062, 23.10934304144901, -0.00023663490511, -0.6321817810242, -0.00663494467273, 0.03430082397953, -0.00466043876332, 2555164.4},
+		{2.890871144776878e-9, 0.000008983055095805407, -3.068298e-8, 7.47137025468032, -0.00000353937994, -0.02145144861037, -0.00001234426596, 0.00010322952773, -0.00000323890364, 826088.5},
+	}
+
+	ll2mc = [][]float64{
+		{-0.0015702102444, 111320.7020616939, 1704480524535203, -10338987376042340, 26112667856603880, -35149669176653700, 26595700718403920, -10725012454188240, 1800819912950474, 82.5},
+		{0.0008277824516172526, 111320.7020463578, 647795574.6671607, -4082003173.641316, 10774905663.51142, -15171875531.51559, 12053065338.62167, -5124939663.577472, 913311935.9512032, 67.5},
+		{0.00337398766765, 111320.7020202162, 4481351.045890365, -23393751.19931662, 79682215.47186455, -115964993.2797253, 97236711.15602145, -43661946.33752821, 8477230.501135234, 52.5},
+		{0.00220636496208, 111320.7020209128, 51751.86112841131, 3796837.749470245, 992013.7397791013, -1221952.21711287, 1340652.697009075, -620943.6990984312, 144416.9293806241, 37.5},
+		{-0.0003441963504368392, 111320.7020576856, 278.2353980772752, 2485758.690035394, 6070.750963243378, 54821.18345352118, 9540.606633304236, -2710.55326746645, 1405.483844121726, 22.5},
+		{-0.0003218135878613132, 111320.7020701615, 0.00369383431289, 823725.6402795718, 0.46104986909093, 2351.343141331292, 1.58060784298199, 8.77738589078284, 0.37238884252424, 7.45},
+	}
+)
+
+const (
+	bd09MaxLatitude = 74
+	bd09MinLatitude = -74
+	bd09TileSize    = 256
+	bd09BaseZoom    = 18
+)
+
+// BD09ToMercator 定义
+// 将BD09经纬度转换为百度墨卡托坐标。
+func BD09ToMercator(lng float64, lat float64) (x float64, y float64) {
+	lng = math.Max(math.Min(lng, 180), -180)
+	lat = math.Max(math.Min(lat, bd09MaxLatitude), bd09MinLatitude)
+
+	var factor []float64
+	for i, band := range llBand {
+		if lat >= band {
+			factor = ll2mc[i]
+			break
+		}
+	}
+	if factor == nil {
+		for i := len(llBand) - 1; i >= 0; i-- {
+			if lat <= -llBand[i] {
+				factor = ll2mc[i]
+				break
+			}
+		}
+	}
+	return bd09Convert(lng, lat, factor)
+}
+
+// MercatorToBD09 定义
+// 将百度墨卡托坐标转换为BD09经纬度。
+func MercatorToBD09(x float64, y float64) (lng float64, lat float64) {
+	absY := math.Abs(y)
+	factor := mc2ll[len(mc2ll)-1]
+	for i, band := range mcBand {
+		if absY >= band {
+			factor = mc2ll[i]
+			break
+		}
+	}
+	return bd09Convert(x, y, factor)
+}
+
+// bd09Convert 定义
+func bd09Convert(x float64, y float64, factor []float64) (float64, float64) {
+	convertedX := factor[0] + factor[1]*math.Abs(x)
+	c := math.Abs(y) / factor[9]
+	convertedY := factor[2] + factor[3]*c + factor[4]*c*c + factor[5]*c*c*c + factor[6]*c*c*c*c + factor[7]*c*c*c*c*c + factor[8]*c*c*c*c*c*c
+	if x < 0 {
+		convertedX = -convertedX
+	}
+	if y < 0 {
+		convertedY = -convertedY
+	}
+	return convertedX, convertedY
+}
+
+// bd09UnitSize 定义
+// 指定层级下一个瓦片对应的墨卡托长度。
+func bd09UnitSize(zoomLevel int) float64 {
+	return math.Pow(2, float64(bd09BaseZoom-zoomLevel)) * bd09TileSize
+}
+
+// BD09ToTile 定义
+func BD09ToTile(lng float64, lat float64, zoomLevel int) (x int64, y int64) {
+	mcX, mcY := BD09ToMercator(lng, lat)
+	unitSize := bd09UnitSize(zoomLevel)
+	x = int64(math.Floor(mcX / unitSize))
+	y = int64(math.Floor(mcY / unitSize))
+	return
+}
+
+// TileToBD09 定义
+// 返回瓦片左下角的BD09经纬度。
+func TileToBD09(x int64, y int64, zoomLevel int) (lng float64, lat float64) {
+	unitSize := bd09UnitSize(zoomLevel)
+	return MercatorToBD09(float64(x)*unitSize, float64(y)*unitSize)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// projectionPoints 定义
+// 覆盖全部纬度分带，包括西藏、海南、黑龙江等边远地区。
+var projectionPoints = []struct {
+	name     string
+	lng, lat float64
+}{
+	{"北京天安门", 116.404, 39.915},
+	{"上海", 121.47, 31.23},
+	{"西藏阿里", 80.1, 32.5},
+	{"新疆乌恰（最西端）", 73.67, 39.47},
+	{"海南三亚", 109.5, 18.25},
+	{"黑龙江漠河", 122.5, 53.48},
+	{"南海", 112.3, 9.5},
+}
+
+// TestBD09MercatorRoundTrip 定义
+func TestBD09MercatorRoundTrip(t *testing.T) {
+	for _, point := range projectionPoints {
+		x, y := BD09ToMercator(point.lng, point.lat)
+		lng, lat := MercatorToBD09(x, y)
+		if math.Abs(lng-point.lng) > 1e-6 || math.Abs(lat-point.lat) > 1e-6 {
+			t.Errorf("%s：%f,%f转换为墨卡托坐标%f,%f后转回%f,%f", point.name, point.lng, point.lat, x, y, lng, lat)
+		}
+	}
+}
+
+// TestBD09ToMercator 定义
+// 百度地图API中天安门的墨卡托坐标为12958175,4825923.77。
+func TestBD09ToMercator(t *testing.T) {
+	x, y := BD09ToMercator(116.404, 39.915)
+	if math.Abs(x-12958175) > 0.01 || math.Abs(y-4825923.77) > 0.01 {
+		t.Errorf("天安门的墨卡托坐标为%f,%f", x, y)
+	}
+}
+
+// TestBD09ToTile 定义
+func TestBD09ToTile(t *testing.T) {
+	tests := []struct {
+		name      string
+		lng, lat  float64
+		zoomLevel int
+		x, y      int64
+	}{
+		{"北京天安门", 116.404, 39.915, 18, 50617, 18851},
+		{"北京天安门", 116.404, 39.915, 15, 6327, 2356},
+		{"北京天安门", 116.404, 39.915, 10, 197, 73},
+		{"北京天安门", 116.404, 39.915, 5, 6, 2},
+		{"上海", 121.47, 31.23, 18, 52820, 14219},
+		{"西藏阿里", 80.1, 32.5, 18, 34831, 14867},
+		{"西藏阿里", 80.1, 32.5, 10, 136, 58},
+		{"新疆乌恰（最西端）", 73.67, 39.47, 15, 4004, 2325},
+		{"海南三亚", 109.5, 18.25, 18, 47615, 8020},
+		{"海南三亚", 109.5, 18.25, 5, 5, 0},
+		{"黑龙江漠河", 122.5, 53.48, 18, 53268, 27490},
+		{"黑龙江漠河", 122.5, 53.48, 10, 208, 107},
+	}
+	for _, test := range tests {
+		x, y := BD09ToTile(test.lng, test.lat, test.zoomLevel)
+		if x != test.x || y != test.y {
+			t.Errorf("%s第%d级：瓦片为%d,%d，应为%d,%d", test.name, test.zoomLevel, x, y, test.x, test.y)
+		}
+	}
+}
+
+// TestTileToBD09 定义
+// 瓦片左下角转回经纬度后应落在同一个瓦片中。
+func TestTileToBD09(t *testing.T) {
+	for _, point := range projectionPoints {
+		for zoomLevel := 3; zoomLevel <= baiduMaxZoom; zoomLevel++ {
+			x, y := BD09ToTile(point.lng, point.lat, zoomLevel)
+			lng, lat := TileToBD09(x, y, zoomLevel)
+			tileX, tileY := BD09ToTile(lng+1e-6, lat+1e-6, zoomLevel)
+			if tileX != x || tileY != y {
+				t.Errorf("%s第%d级：瓦片%d,%d的左下角%f,%f属于瓦片%d,%d", point.name, zoomLevel, x, y, lng, lat, tileX, tileY)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion WebSocket消息协议的版本
+const ProtocolVersion = 1
+
+// 消息类型定义
+// submit、command、subscribe和unsubscribe由客户端发送，其余由服务端发送。
+// accepted、rejected和error只回复给发送请求的连接，
+// 带有jobId的事件只发送给订阅了该任务的连接。
+const (
+	MessageTypeSubmit        = "submit"
+	MessageTypeCommand       = "command"
+	MessageTypeSubscribe     = "subscribe"
+	MessageTypeUnsubscribe   = "unsubscribe"
+	MessageTypeAccepted      = "accepted"
+	MessageTypeRejected      = "rejected"
+	MessageTypeProgress      = "progress"
+	MessageTypeRoundComplete = "round-complete"
+	MessageTypeJobComplete   = "job-complete"
+	MessageTypeError         = "error"
+	// MessageTypeMessage 其他面向用户的提示，如下载开始、限速调整、状态查询结果
+	MessageTypeMessage = "message"
+)
+
+// Envelope 定义
+// 所有WebSocket消息的外层结构。服务端消息的seq全局递增，
+// replyTo为所回复的客户端消息的seq。
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	JobID   int             `json:"jobId,omitempty"`
+	Seq     uint64          `json:"seq"`
+	ReplyTo uint64          `json:"replyTo,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// JobEvent 定义
+// 下载任务和任务管理产生的事件，由传输层包装为Envelope。
+type JobEvent struct {
+	Type    string
+	JobID   int
+	Payload interface{}
+}
+
+// EventCallback 定义
+type EventCallback func(event *JobEvent)
+
+// Requester 定义
+// 发送请求的连接。Reply只发送给该连接；Watch和Unwatch修改该连接订阅的任务，
+// 返回后该连接即开始（或停止）接收任务的事件。
+type Requester interface {
+	Reply(event *JobEvent)
+	Watch(jobID int)
+	Unwatch(jobID int)
+}
+
+// JobWatcher 定义
+// 任务创建后、发出第一条事件前调用。
+type JobWatcher func(jobID int)
+
+// RequestCallback 定义
+type RequestCallback func(request *Envelope, requester Requester)
+
+// EventText 定义
+// 每种消息都带有一句中文说明，旧页面和命令行直接显示。
+type EventText struct {
+	Text string `json:"text,omitempty"`
+}
+
+// eventText 定义
+func (eventText EventText) eventText() string {
+	return eventText.Text
+}
+
+// MessagePayload 定义
+type MessagePayload struct {
+	EventText
+}
+
+// AcceptedPayload 定义
+type AcceptedPayload struct {
+	EventText
+	JobID int `json:"jobId,omitempty"`
+}
+
+// RejectedPayload 定义
+type RejectedPayload struct {
+	EventText
+	Error string `json:"error"`
+}
+
+// ErrorPayload 定义
+type ErrorPayload struct {
+	EventText
+	Error string `json:"error"`
+}
+
+// ProgressPayload 定义
+type ProgressPayload struct {
+	EventText
+	Round        int    `json:"round"`
+	Counter      uint64 `json:"counter"`
+	Total        uint64 `json:"total"`
+	ErrorCounter uint64 `json:"errorCounter"`
+	SkipCounter  uint64 `json:"skipCounter"`
+	Concurrency  int    `json:"concurrency,omitempty"`
+}
+
+// RoundCompletePayload 定义
+type RoundCompletePayload struct {
+	EventText
+	Round            int               `json:"round"`
+	Counter          uint64            `json:"counter"`
+	Total            uint64            `json:"total"`
+	ErrorCounter     uint64            `json:"errorCounter"`
+	PermanentCounter uint64            `json:"permanentCounter"`
+	SkipCounter      uint64            `json:"skipCounter"`
+	BlankCounter     uint64            `json:"blankCounter"`
+	PlaceholderCount uint64            `json:"placeholderCounter"`
+	ErrorReasons     map[string]uint64 `json:"errorReasons,omitempty"`
+}
+
+// JobCompletePayload 定义
+type JobCompletePayload struct {
+	EventText
+	State        string `json:"state"`
+	JobPath      string `json:"jobPath"`
+	Counter      uint64 `json:"counter"`
+	Total        uint64 `json:"total"`
+	ErrorCounter uint64 `json:"errorCounter"`
+	Error        string `json:"error,omitempty"`
+}
+
+// SubmitPayload 定义
+type SubmitPayload struct {
+	Provinces       []string        `json:"provinces"`
+	MinZoom         *int            `json:"minZoom"`
+	MaxZoom         *int            `json:"maxZoom"`
+	Provider        string          `json:"provider"`
+	Storage         string          `json:"storage"`
+	Longitude       []float64       `json:"longitude"`
+	Latitude        []float64       `json:"latitude"`
+	Datum           string          `json:"datum"`
+	GeoJSON         json.RawMessage `json:"geoJson"`
+	JobPath         string          `json:"jobPath"`
+	Dedupe          bool            `json:"dedupe"`
+	EmptyTilePolicy string          `json:"emptyTilePolicy"`
+}
+
+// SubscribePayload 定义
+// subscribe和unsubscribe使用，提交任务的连接会自动订阅该任务。
+type SubscribePayload struct {
+	JobIDs []int `json:"jobIds"`
+}
+
+// CommandPayload 定义
+// 任务编号使用Envelope中的jobId；estimate使用para中的参数。
+type CommandPayload struct {
+	Command                  string         `json:"command"`
+	JobPath                  string         `json:"jobPath"`
+	RequestsPerSecond        *float64       `json:"requestsPerSecond"`
+	RequestsPerSecondPerHost *float64       `json:"requestsPerSecondPerHost"`
+	BytesPerSecond           *float64       `json:"bytesPerSecond"`
+	Para                     *SubmitPayload `json:"para"`
+}
+
+// textEvent 定义
+func textEvent(eventType string, jobID int, text string) *JobEvent {
+	return &JobEvent{eventType, jobID, MessagePayload{EventText{text}}}
+}
+
+// eventText 定义
+// 返回事件的中文说明，没有说明时返回空字符串。
+func eventText(event *JobEvent) string {
+	if payload, ok := event.Payload.(interface{ eventText() string }); ok {
+		return payload.eventText()
+	}
+	return ""
+}
+
+// NewEnvelope 定义
+func NewEnvelope(event *JobEvent, seq uint64, replyTo uint64) (*Envelope, error) {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{ProtocolVersion, event.Type, event.JobID, seq, replyTo, payload}, nil
+}
+
+// ParseEnvelope 定义
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("消息不是有效的JSON：%s", err.Error())
+	}
+	if envelope.Version != ProtocolVersion {
+		return &envelope, fmt.Errorf("不支持的协议版本%d，当前版本为%d", envelope.Version, ProtocolVersion)
+	}
+	switch envelope.Type {
+	case MessageTypeSubmit, MessageTypeCommand, MessageTypeSubscribe, MessageTypeUnsubscribe:
+	default:
+		return &envelope, fmt.Errorf("不支持的消息类型%s", envelope.Type)
+	}
+	return &envelope, nil
+}
+
+// DecodePayload 定义
+// 不允许出现未定义的字段，避免拼错的参数被静默忽略。
+func (envelope *Envelope) DecodePayload(value interface{}) error {
+	if len(envelope.Payload) == 0 {
+		return errors.New("缺少payload")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(envelope.Payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("payload格式错误：%s", err.Error())
+	}
+	return nil
+}
+
+// message 定义
+// 检查参数并转换为analysePara使用的格式。
+func (payload *SubmitPayload) message() ([]byte, error) {
+	if payload.MinZoom == nil || payload.MaxZoom == nil {
+		return nil, errors.New("缺少minZoom或maxZoom")
+	}
+	if len(payload.Longitude) != 0 && len(payload.Longitude) != 2 {
+		return nil, errors.New("longitude应为[最小经度, 最大经度]")
+	}
+	if len(payload.Latitude) != 0 && len(payload.Latitude) != 2 {
+		return nil, errors.New("latitude应为[最小纬度, 最大纬度]")
+	}
+	if len(payload.Longitude) != len(payload.Latitude) {
+		return nil, errors.New("longitude和latitude需要同时指定")
+	}
+	dat := map[string]interface{}{
+		"MinZoomLevel":    *payload.MinZoom,
+		"MaxZoomLevel":    *payload.MaxZoom,
+		"Province":        strings.Join(payload.Provinces, ","),
+		"Provider":        payload.Provider,
+		"Storage":         payload.Storage,
+		"Longitude":       payload.Longitude,
+		"Latitude":        payload.Latitude,
+		"Datum":           payload.Datum,
+		"JobPath":         payload.JobPath,
+		"Dedupe":          payload.Dedupe,
+		"EmptyTilePolicy": payload.EmptyTilePolicy,
+	}
+	if len(payload.GeoJSON) != 0 && string(payload.GeoJSON) != "null" {
+		// geoJson可以是GeoJSON对象，也可以是GeoJSON字符串
+		var geoJSON interface{}
+		if err := json.Unmarshal(payload.GeoJSON, &geoJSON); err != nil {
+			return nil, err
+		}
+		dat["GeoJSON"] = geoJSON
+	}
+	return json.Marshal(dat)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 令牌不足时单次等待的最长时间，等待结束后重新检查，使调整后的限速尽快生效
+const rateLimitMaxWait = time.Second
+
+// RateLimitConfigStruct 定义
+// 各项为0时不限制。
+type RateLimitConfigStruct struct {
+	RequestsPerSecond        float64
+	RequestsPerSecondPerHost float64
+	BytesPerSecond           float64
+}
+
+// TokenBucket 定义
+// 令牌桶容量为一秒的令牌数（至少为1）。
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 定义
+func NewTokenBucket(rate float64) *TokenBucket {
+	bucket := new(TokenBucket)
+	bucket.SetRate(rate)
+	return bucket
+}
+
+// refill 定义
+func (bucket *TokenBucket) refill(now time.Time) {
+	if !bucket.last.IsZero() {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	}
+	bucket.last = now
+}
+
+// SetRate 定义
+func (bucket *TokenBucket) SetRate(rate float64) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.refill(time.Now())
+	if bucket.rate <= 0 {
+		// 从不限速改为限速时桶是满的
+		bucket.tokens = math.Max(rate, 1)
+	}
+	bucket.rate = rate
+	bucket.burst = math.Max(rate, 1)
+	bucket.tokens = math.Min(bucket.tokens, bucket.burst)
+}
+
+// take 定义
+// 令牌足够时取出n个令牌并返回0，否则返回需要等待的时间。
+// n大于桶容量时只要桶满即可取出，不足部分记为欠账。
+func (bucket *TokenBucket) take(n float64) time.Duration {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if bucket.rate <= 0 {
+		return 0
+	}
+	bucket.refill(time.Now())
+	need := math.Min(n, bucket.burst)
+	if bucket.tokens >= need {
+		bucket.tokens -= n
+		return 0
+	}
+	return time.Duration((need - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// Wait 定义
+func (bucket *TokenBucket) Wait(ctx context.Context, n float64) error {
+	for {
+		delay := bucket.take(n)
+		if delay <= 0 {
+			return nil
+		}
+		if delay > rateLimitMaxWait {
+			delay = rateLimitMaxWait
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// RateLimiter 定义
+// 所有任务共用：全局请求数、每个服务器的请求数和下载带宽分别限制。
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    RateLimitConfigStruct
+	global    *TokenBucket
+	bandwidth *TokenBucket
+	hosts     map[string]*TokenBucket
+}
+
+// NewRateLimiter 定义
+func NewRateLimiter(config RateLimitConfigStruct) *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.config = config
+	limiter.global = NewTokenBucket(config.RequestsPerSecond)
+	limiter.bandwidth = NewTokenBucket(config.BytesPerSecond)
+	limiter.hosts = make(map[string]*TokenBucket)
+	return limiter
+}
+
+// urlHost 定义
+// 无法解析时返回原地址。
+func urlHost(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return rawURL
+}
+
+// hostBucket 定义
+func (limiter *RateLimiter) hostBucket(rawURL string) *TokenBucket {
+	host := urlHost(rawURL)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	bucket, ok := limiter.hosts[host]
+	if !ok {
+		bucket = NewTokenBucket(limiter.config.RequestsPerSecondPerHost)
+		limiter.hosts[host] = bucket
+	}
+	return bucket
+}
+
+// WaitRequest 定义
+func (limiter *RateLimiter) WaitRequest(ctx context.Context, rawURL string) error {
+	if err := limiter.hostBucket(rawURL).Wait(ctx, 1); err != nil {
+		return err
+	}
+	return limiter.global.Wait(ctx, 1)
+}
+
+// WaitBytes 定义
+// 下载完成后按瓦片大小扣除带宽令牌，超出部分由后续请求等待。
+func (limiter *RateLimiter) WaitBytes(ctx context.Context, size int) error {
+	return limiter.bandwidth.Wait(ctx, float64(size))
+}
+
+// SetConfig 定义
+func (limiter *RateLimiter) SetConfig(config RateLimitConfigStruct) {
+	limiter.mu.Lock()
+	limiter.config = config
+	hosts := make([]*TokenBucket, 0, len(limiter.hosts))
+	for _, bucket := range limiter.hosts {
+		hosts = append(hosts, bucket)
+	}
+	limiter.mu.Unlock()
+	limiter.global.SetRate(config.RequestsPerSecond)
+	limiter.bandwidth.SetRate(config.BytesPerSecond)
+	for _, bucket := range hosts {
+		bucket.SetRate(config.RequestsPerSecondPerHost)
+	}
+}
+
+// Config 定义
+func (limiter *RateLimiter) Config() RateLimitConfigStruct {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.config
+}
+
+// String 定义
+func (config RateLimitConfigStruct) String() string {
+	limit := func(value float64, format func(float64) string) string {
+		if value <= 0 {
+			return "不限"
+		}
+		return format(value)
+	}
+	requests := func(value float64) string {
+		return fmt.Sprintf("%g次/秒", value)
+	}
+	bytes := func(value float64) string {
+		return formatBytes(uint64(value)) + "/秒"
+	}
+	return fmt.Sprintf("限速：全局%s，每个服务器%s，带宽%s。", limit(config.RequestsPerSecond, requests), limit(config.RequestsPerSecondPerHost, requests), limit(config.BytesPerSecond, bytes))
+}
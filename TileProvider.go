@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 瓦片坐标方案定义
+const (
+	TileSchemeBaidu = "bd09"
+	TileSchemeXYZ   = "xyz"
+	TileSchemeTMS   = "tms"
+)
+
+// DefaultTileProviderName 定义
+const DefaultTileProviderName = "baidu"
+
+// baiduMaxZoom 百度地图的最大层级
+const baiduMaxZoom = 19
+
+// defaultMaxZoom 配置中没有MaxZoom时地图源的最大层级
+const defaultMaxZoom = 19
+
+// TileProvider 定义
+type TileProvider interface {
+	// Name 返回地图源名称，与提交参数中的Provider对应
+	Name() string
+	// TileURL 返回瓦片地址，多个服务器之间轮流分配，udt为请求的瓦片版本日期
+	TileURL(mapProperties *MapProperties, udt string) string
+	// ValidTile 判断返回内容是否是有效的瓦片
+	ValidTile(data []byte) bool
+	// Scheme 返回瓦片坐标方案
+	Scheme() string
+	// Format 返回瓦片文件扩展名
+	Format() string
+	// Datum 返回瓦片使用的坐标系
+	Datum() string
+	// MaxZoom 返回地图源提供的最大层级
+	MaxZoom() int
+}
+
+// TileProviderConfigStruct 定义
+type TileProviderConfigStruct struct {
+	Name        string
+	Title       string
+	URLTemplate string
+	Subdomains  []string
+	Scheme      string
+	Format      string
+	Datum       string
+	MaxZoom     int
+	HTTPClient  *HTTPClientConfigStruct
+}
+
+// BaiduMapServerInfo 定义
+type BaiduMapServerInfo struct {
+	MinServerID     int
+	MaxServerID     int
+	CurrentServerID int
+}
+
+// BaiduTileProvider 定义
+type BaiduTileProvider struct {
+	baiduMapServer *BaiduMapServerInfo
+	counter        uint64
+}
+
+// NewBaiduTileProvider 定义
+func NewBaiduTileProvider() *BaiduTileProvider {
+	provider := new(BaiduTileProvider)
+	provider.baiduMapServer = &BaiduMapServerInfo{
+		MinServerID: 0, MaxServerID: 3, CurrentServerID: 0,
+	}
+	return provider
+}
+
+var urlTemplate = "http://online%d.map.bdimg.com/onlinelabel/?qt=tile&x=%d&y=%d&z=%d&styles=pl&scaler=1&udt=%s"
+
+// Name 定义
+func (provider *BaiduTileProvider) Name() string {
+	return DefaultTileProviderName
+}
+
+// TileURL 定义
+func (provider *BaiduTileProvider) TileURL(mapProperties *MapProperties, udt string) string {
+	serverCount := uint64(provider.baiduMapServer.MaxServerID - provider.baiduMapServer.MinServerID + 1)
+	serverID := provider.baiduMapServer.MinServerID + int((atomic.AddUint64(&provider.counter, 1)-1)%serverCount)
+	url := fmt.Sprintf(urlTemplate, serverID, mapProperties.x, mapProperties.y, mapProperties.zoomLevel, udt)
+	url = strings.Replace(url, "-", "M", 0)
+	return url
+}
+
+// ValidTile 定义
+func (provider *BaiduTileProvider) ValidTile(data []byte) bool {
+	return isPNG(data)
+}
+
+// Scheme 定义
+func (provider *BaiduTileProvider) Scheme() string {
+	return TileSchemeBaidu
+}
+
+// Format 定义
+func (provider *BaiduTileProvider) Format() string {
+	return "png"
+}
+
+// Datum 定义
+func (provider *BaiduTileProvider) Datum() string {
+	return DatumBD09
+}
+
+// MaxZoom 定义
+func (provider *BaiduTileProvider) MaxZoom() int {
+	return baiduMaxZoom
+}
+
+// TemplateTileProvider 定义
+// URLTemplate中可以使用{s}、{x}、{y}、{z}、{udt}、{time}占位符。
+type TemplateTileProvider struct {
+	config  TileProviderConfigStruct
+	counter uint64
+}
+
+// NewTemplateTileProvider 定义
+func NewTemplateTileProvider(config TileProviderConfigStruct) (*TemplateTileProvider, error) {
+	if config.Name == "" || config.URLTemplate == "" {
+		return nil, fmt.Errorf("tile provider must have Name and URLTemplate")
+	}
+	switch config.Scheme {
+	case "":
+		config.Scheme = TileSchemeXYZ
+	case TileSchemeBaidu, TileSchemeXYZ, TileSchemeTMS:
+	default:
+		return nil, fmt.Errorf("tile provider %s: unknown scheme %s", config.Name, config.Scheme)
+	}
+	if config.Format == "" {
+		config.Format = "png"
+	}
+	datum, err := normalizeDatum(config.Datum)
+	if err != nil {
+		return nil, fmt.Errorf("tile provider %s: %s", config.Name, err.Error())
+	}
+	if datum == "" {
+		// 百度坐标方案默认使用BD-09，其他方案默认使用WGS84
+		datum = DatumWGS84
+		if config.Scheme == TileSchemeBaidu {
+			datum = DatumBD09
+		}
+	}
+	config.Datum = datum
+	if config.MaxZoom < 0 {
+		return nil, fmt.Errorf("tile provider %s: invalid MaxZoom %d", config.Name, config.MaxZoom)
+	}
+	if config.MaxZoom == 0 {
+		config.MaxZoom = defaultMaxZoom
+	}
+	provider := new(TemplateTileProvider)
+	provider.config = config
+	return provider, nil
+}
+
+// Name 定义
+func (provider *TemplateTileProvider) Name() string {
+	return provider.config.Name
+}
+
+// TileURL 定义
+func (provider *TemplateTileProvider) TileURL(mapProperties *MapProperties, udt string) string {
+	now := time.Now()
+	replacements := []string{
+		"{x}", strconv.FormatInt(mapProperties.x, 10),
+		"{y}", strconv.FormatInt(mapProperties.y, 10),
+		"{z}", strconv.Itoa(mapProperties.zoomLevel),
+		"{udt}", udt,
+		"{time}", strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+	}
+	if len(provider.config.Subdomains) > 0 {
+		index := (atomic.AddUint64(&provider.counter, 1) - 1) % uint64(len(provider.config.Subdomains))
+		replacements = append(replacements, "{s}", provider.config.Subdomains[index])
+	}
+	return strings.NewReplacer(replacements...).Replace(provider.config.URLTemplate)
+}
+
+// ValidTile 定义
+func (provider *TemplateTileProvider) ValidTile(data []byte) bool {
+	switch provider.config.Format {
+	case "png":
+		return isPNG(data)
+	case "jpg", "jpeg":
+		return isJPEG(data)
+	}
+	return len(data) > 0
+}
+
+// Scheme 定义
+func (provider *TemplateTileProvider) Scheme() string {
+	return provider.config.Scheme
+}
+
+// Format 定义
+func (provider *TemplateTileProvider) Format() string {
+	return provider.config.Format
+}
+
+// Datum 定义
+func (provider *TemplateTileProvider) Datum() string {
+	return provider.config.Datum
+}
+
+// MaxZoom 定义
+func (provider *TemplateTileProvider) MaxZoom() int {
+	return provider.config.MaxZoom
+}
+
+// tileUDT 定义
+// 瓦片地址中的udt参数为下载当天的日期，百度按该日期返回对应版本的瓦片。
+func tileUDT(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// isPNG 定义
+func isPNG(data []byte) bool {
+	return len(data) > 4 && data[1] == 'P' && data[2] == 'N' && data[3] == 'G'
+}
+
+// isJPEG 定义
+func isJPEG(data []byte) bool {
+	return len(data) > 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF
+}
+
+// isCompleteImage 定义
+// 检查PNG的IEND块和JPEG的结束标记，用于发现下载中断而被截断的文件。
+func isCompleteImage(data []byte) bool {
+	switch {
+	case isPNG(data):
+		return bytes.HasSuffix(data, []byte{'I', 'E', 'N', 'D', 0xAE, 0x42, 0x60, 0x82})
+	case isJPEG(data):
+		return bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xFF, 0xD9})
+	}
+	return len(data) > 0
+}
+
+// projectToTile 定义
+// 将经纬度换算为指定层级下的瓦片坐标（含小数部分），瓦片(x, y)覆盖[x, x+1)×[y, y+1)。
+func projectToTile(scheme string, zoomLevel int, lng float64, lat float64) (x float64, y float64) {
+	switch scheme {
+	case TileSchemeXYZ, TileSchemeTMS:
+		n := math.Pow(2, float64(zoomLevel))
+		latRad := lat * math.Pi / 180
+		x = clampTile((lng+180)/360*n, n)
+		// XYZ方案的y轴向南增长
+		y = clampTile((1-math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi)/2*n, n)
+		if scheme == TileSchemeTMS {
+			y = clampTile(n-y, n)
+		}
+	default:
+		// 百度瓦片的y轴向北增长
+		mcX, mcY := BD09ToMercator(lng, lat)
+		unitSize := bd09UnitSize(zoomLevel)
+		x = mcX / unitSize
+		y = mcY / unitSize
+	}
+	return
+}
+
+// clampTile 定义
+func clampTile(value float64, n float64) float64 {
+	if math.IsNaN(value) || value < 0 {
+		return 0
+	}
+	if value >= n {
+		return math.Nextafter(n, 0)
+	}
+	return value
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 未完成的任务每隔一段时间重新读取断点文件，以便完成后改用长缓存
+	tileServerRefreshInterval = 5 * time.Second
+	tileCacheMaxAge           = 7 * 24 * 3600
+)
+
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// servedJob 定义
+type servedJob struct {
+	jobPath      string
+	storage      TileStorage
+	scheme       string
+	format       string
+	minZoomLevel int
+	maxZoomLevel int
+	// centerX、centerY为maxZoomLevel层级下的瓦片坐标
+	centerX, centerY float64
+	finished         bool
+	loadTime         time.Time
+	// version 由清单文件的大小和修改时间得出，用作已完成任务中瓦片的ETag
+	version string
+}
+
+// PreviewStruct 定义
+type PreviewStruct struct {
+	Job          string
+	Scheme       string
+	Format       string
+	MinZoomLevel int
+	MaxZoomLevel int
+	CenterX      float64
+	CenterY      float64
+}
+
+// TileServer 定义
+// 通过/tiles/{job}/{z}/{x}/{y}.png提供已下载任务目录（map、map1……）中的瓦片，
+// 通过/preview/{job}提供预览页面。
+type TileServer struct {
+	config *ConfigStruct
+	// jobActive返回任务目录是否有排队或正在下载的任务，有任务时不使用缓存的任务信息
+	jobActive   func(jobPath string) bool
+	previewTmpl *template.Template
+	jobs        map[string]*servedJob
+	mu          sync.Mutex
+}
+
+// NewTileServer 定义
+func NewTileServer(config *ConfigStruct, pathName string, pageName string) *TileServer {
+	server := new(TileServer)
+	server.config = config
+	server.previewTmpl = template.Must(template.ParseFiles(pathName + "/" + pageName))
+	server.jobs = make(map[string]*servedJob)
+	return server
+}
+
+// openJob 定义
+// 只提供有断点文件的任务目录。
+func (server *TileServer) openJob(name string) (job *servedJob, err error) {
+	if !jobNamePattern.MatchString(name) || name == "." || name == ".." {
+		return nil, os.ErrNotExist
+	}
+	jobPath, err := AbsJobPath(name)
+	if err != nil {
+		return
+	}
+	checkpoint, err := LoadJobCheckpoint(jobPath)
+	if err != nil {
+		return nil, err
+	}
+	para := checkpoint.Para()
+	provider, err := server.config.TileProvider(para.provider)
+	if err != nil {
+		return nil, err
+	}
+	storage := para.storage
+	if storage == "" {
+		storage = StorageFile
+	}
+	job = &servedJob{
+		jobPath:      jobPath,
+		scheme:       provider.Scheme(),
+		format:       provider.Format(),
+		minZoomLevel: para.minZoomLevel,
+		maxZoomLevel: para.maxZoomLevel,
+		finished:     checkpoint.Snapshot().Finished && !server.isJobActive(jobPath),
+		loadTime:     time.Now(),
+	}
+	if info, err := os.Stat(jobPath + manifestFileName); err == nil {
+		sum := sha1.Sum([]byte(fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())))
+		job.version = hex.EncodeToString(sum[:8])
+	}
+	job.centerX, job.centerY = polygonCenter(job.scheme, job.maxZoomLevel, checkpoint.Polygons())
+	job.storage, err = OpenTileStorageReader(storage, jobPath, job.format, job.scheme)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// getJob 定义
+func (server *TileServer) getJob(name string) (*servedJob, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	job, ok := server.jobs[name]
+	if ok && job.finished && server.isJobActive(job.jobPath) {
+		// 已完成的任务目录开始了新的下载，瓦片可能变化
+		job.finished = false
+		job.loadTime = time.Time{}
+	}
+	if ok && (job.finished || time.Since(job.loadTime) < tileServerRefreshInterval) {
+		return job, nil
+	}
+	newJob, err := server.openJob(name)
+	if err != nil {
+		if ok {
+			return job, nil
+		}
+		return nil, err
+	}
+	if ok {
+		// 其他请求可能仍在读取原来的存储，继续使用原来的存储
+		newJob.storage.Close()
+		newJob.storage = job.storage
+	}
+	server.jobs[name] = newJob
+	return newJob, nil
+}
+
+// isJobActive 定义
+func (server *TileServer) isJobActive(jobPath string) bool {
+	return server.jobActive != nil && server.jobActive(jobPath)
+}
+
+// ServeTile 定义
+func (server *TileServer) ServeTile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tiles/"), "/")
+	if len(parts) != 4 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	zoomLevel, errZ := strconv.Atoi(parts[1])
+	x, errX := strconv.ParseInt(parts[2], 10, 64)
+	y, errY := strconv.ParseInt(strings.TrimSuffix(parts[3], filepath.Ext(parts[3])), 10, 64)
+	if errZ != nil || errX != nil || errY != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	job, err := server.getJob(parts[0])
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	// 已完成的任务按清单的版本生成ETag，清单不变时不需要读取瓦片就能回复304
+	etag := ""
+	if job.finished && job.version != "" {
+		etag = `"` + job.version + `"`
+		if notModified(w, r, job, etag) {
+			return
+		}
+	}
+	data, err := job.storage.ReadTile(&MapProperties{zoomLevel, x, y})
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Not found", 404)
+		} else {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+	if etag == "" {
+		sum := sha1.Sum(data)
+		etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+		if notModified(w, r, job, etag) {
+			return
+		}
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(data)
+}
+
+// notModified 定义
+// 设置ETag和缓存头，请求中的ETag与之相同时回复304并返回true。
+func notModified(w http.ResponseWriter, r *http.Request, job *servedJob, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if job.finished {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", tileCacheMaxAge))
+	} else {
+		// 任务仍在下载，瓦片可能被重新下载，每次都需要用ETag验证
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ServePreview 定义
+func (server *TileServer) ServePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/preview/"), "/")
+	job, err := server.getJob(name)
+	if err != nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	preview := PreviewStruct{name, job.scheme, job.format, job.minZoomLevel, job.maxZoomLevel, job.centerX, job.centerY}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	server.previewTmpl.Execute(w, preview)
+}
+
+// polygonCenter 定义
+// 返回下载区域外接矩形中心在指定层级下的瓦片坐标，没有区域时使用北京。
+func polygonCenter(scheme string, zoomLevel int, polygons []PolygonStruct) (float64, float64) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, polygon := range polygons {
+		for _, ring := range polygon.rings {
+			for _, point := range ring {
+				x, y := projectToTile(scheme, zoomLevel, point[0], point[1])
+				minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+				minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+			}
+		}
+	}
+	if math.IsInf(minX, 1) {
+		return projectToTile(scheme, zoomLevel, 116.404, 39.915)
+	}
+	return (minX + maxX) / 2, (minY + maxY) / 2
+}
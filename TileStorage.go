@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// 瓦片存储方式定义
+const (
+	StorageFile    = "file"
+	StorageMBTiles = "mbtiles"
+)
+
+const (
+	mbtilesFileName  = "tiles.mbtiles"
+	mbtilesBatchSize = 500
+	tileBlobDirName  = "blobs"
+)
+
+// TileStorage 定义
+type TileStorage interface {
+	// WriteTile 保存一个瓦片
+	WriteTile(mapProperties *MapProperties, data []byte) error
+	// ReadTile 读取一个瓦片，不存在时返回os.ErrNotExist
+	ReadTile(mapProperties *MapProperties) ([]byte, error)
+	// Flush 将缓存的瓦片写入磁盘，保存断点前调用
+	Flush() error
+	// Close 定义
+	Close() error
+}
+
+// TileLinker 定义
+// 支持按内容引用保存瓦片的存储方式，内容相同的瓦片在磁盘上只保存一份。
+type TileLinker interface {
+	LinkTile(mapProperties *MapProperties, data []byte, hash [sha256.Size]byte) error
+	// LinkStats 返回本次打开后LinkTile的实际结果
+	LinkStats() TileLinkStats
+	// RemoveOrphans 删除没有瓦片引用的内容，返回删除的数量和大小；
+	// 文件方式按referenced判断，MBTiles按map表判断
+	RemoveOrphans(referenced map[[sha256.Size]byte]bool) (count int, size uint64, err error)
+}
+
+// TileLinkStats 定义
+type TileLinkStats struct {
+	// Tiles、Bytes LinkTile保存的瓦片数和大小
+	Tiles, Bytes uint64
+	// Shared、SavedBytes 与已有内容共用、没有占用空间的瓦片数和大小
+	Shared, SavedBytes uint64
+	// Copied 无法共用内容而单独保存的瓦片数，如不支持硬链接
+	Copied uint64
+}
+
+// add 定义
+func (stats *TileLinkStats) add(size int, shared bool, copied bool) {
+	atomic.AddUint64(&stats.Tiles, 1)
+	atomic.AddUint64(&stats.Bytes, uint64(size))
+	if shared {
+		atomic.AddUint64(&stats.Shared, 1)
+		atomic.AddUint64(&stats.SavedBytes, uint64(size))
+	}
+	if copied {
+		atomic.AddUint64(&stats.Copied, 1)
+	}
+}
+
+// snapshot 定义
+func (stats *TileLinkStats) snapshot() TileLinkStats {
+	return TileLinkStats{
+		Tiles:      atomic.LoadUint64(&stats.Tiles),
+		Bytes:      atomic.LoadUint64(&stats.Bytes),
+		Shared:     atomic.LoadUint64(&stats.Shared),
+		SavedBytes: atomic.LoadUint64(&stats.SavedBytes),
+		Copied:     atomic.LoadUint64(&stats.Copied),
+	}
+}
+
+// TileStorageMetadata 定义
+type TileStorageMetadata struct {
+	Name                       string
+	Format                     string
+	Scheme                     string
+	MinZoomLevel, MaxZoomLevel int
+	// Bounds 为WGS84经纬度：左、下、右、上
+	Bounds [4]float64
+	// Dedupe 为true时新建的MBTiles文件按内容去重保存瓦片
+	Dedupe bool
+}
+
+// OpenTileStorage 定义
+func OpenTileStorage(storage string, jobPath string, metadata *TileStorageMetadata) (TileStorage, error) {
+	switch storage {
+	case "", StorageFile:
+		return NewFileTileStorage(jobPath, metadata.Format), nil
+	case StorageMBTiles:
+		return OpenMBTilesStorage(fmt.Sprintf("%s/%s", jobPath, mbtilesFileName), metadata)
+	}
+	return nil, fmt.Errorf("unknown storage %s", storage)
+}
+
+// OpenTileStorageReader 定义
+// 以只读方式打开已有任务目录中的瓦片，不修改MBTiles的元数据。
+func OpenTileStorageReader(storage string, jobPath string, format string, scheme string) (TileStorage, error) {
+	switch storage {
+	case "", StorageFile:
+		return NewFileTileStorage(jobPath, format), nil
+	case StorageMBTiles:
+		fileName := fmt.Sprintf("%s/%s", jobPath, mbtilesFileName)
+		if _, err := os.Stat(fileName); err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("sqlite3", mbtilesDSN(fileName, "mode=ro"))
+		if err != nil {
+			return nil, err
+		}
+		return &MBTilesStorage{db: db, scheme: scheme}, nil
+	}
+	return nil, fmt.Errorf("unknown storage %s", storage)
+}
+
+// FileTileStorage 定义
+// 按z/x/y.png的目录结构保存瓦片。
+type FileTileStorage struct {
+	jobPath   string
+	format    string
+	linkStats TileLinkStats
+}
+
+// NewFileTileStorage 定义
+func NewFileTileStorage(jobPath string, format string) *FileTileStorage {
+	return &FileTileStorage{jobPath: jobPath, format: format}
+}
+
+// tilePath 定义
+func (storage *FileTileStorage) tilePath(mapProperties *MapProperties) (pathName string, fileName string) {
+	pathName = fmt.Sprintf("%s/%d/%d/", storage.jobPath, mapProperties.zoomLevel, mapProperties.x)
+	fileName = fmt.Sprintf("%s/%d.%s", pathName, mapProperties.y, storage.format)
+	return
+}
+
+// WriteTile 定义
+func (storage *FileTileStorage) WriteTile(mapProperties *MapProperties, data []byte) (err error) {
+	pathName, fileName := storage.tilePath(mapProperties)
+	err = os.MkdirAll(pathName, 0777)
+	if err != nil {
+		return
+	}
+	// 已有的文件可能是指向blobs的硬链接，先删除再写，避免改动其他瓦片的内容
+	os.Remove(fileName)
+	err = ioutil.WriteFile(fileName, data, 0644)
+	return
+}
+
+// ReadTile 定义
+func (storage *FileTileStorage) ReadTile(mapProperties *MapProperties) ([]byte, error) {
+	_, fileName := storage.tilePath(mapProperties)
+	return ioutil.ReadFile(fileName)
+}
+
+// LinkTile 定义
+// 内容按SHA-256保存在任务目录的blobs/前两位/SHA-256中，瓦片文件为指向它的硬链接；不支持硬链接时复制一份。
+func (storage *FileTileStorage) LinkTile(mapProperties *MapProperties, data []byte, hash [sha256.Size]byte) (err error) {
+	id := hex.EncodeToString(hash[:])
+	blobPath := fmt.Sprintf("%s/%s/%s/", storage.jobPath, tileBlobDirName, id[:2])
+	blobName := fmt.Sprintf("%s%s.%s", blobPath, id, storage.format)
+	_, err = os.Stat(blobName)
+	exists := err == nil
+	if !exists {
+		if err = os.MkdirAll(blobPath, 0777); err != nil {
+			return
+		}
+		// 先写临时文件再改名，避免其他线程链接到不完整的文件
+		tmpName := fmt.Sprintf("%s.%d.tmp", blobName, time.Now().UnixNano())
+		if err = ioutil.WriteFile(tmpName, data, 0644); err != nil {
+			return
+		}
+		if err = os.Rename(tmpName, blobName); err != nil {
+			os.Remove(tmpName)
+			return
+		}
+	}
+	pathName, fileName := storage.tilePath(mapProperties)
+	if err = os.MkdirAll(pathName, 0777); err != nil {
+		return
+	}
+	os.Remove(fileName)
+	if os.Link(blobName, fileName) == nil {
+		storage.linkStats.add(len(data), exists, false)
+		return
+	}
+	if err = ioutil.WriteFile(fileName, data, 0644); err == nil {
+		storage.linkStats.add(len(data), false, true)
+	}
+	return
+}
+
+// LinkStats 定义
+func (storage *FileTileStorage) LinkStats() TileLinkStats {
+	return storage.linkStats.snapshot()
+}
+
+// RemoveOrphans 定义
+// 删除blobs中清单没有引用的内容。
+func (storage *FileTileStorage) RemoveOrphans(referenced map[[sha256.Size]byte]bool) (count int, size uint64, err error) {
+	root := fmt.Sprintf("%s/%s", storage.jobPath, tileBlobDirName)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		id := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		hash, decodeErr := hex.DecodeString(id)
+		if decodeErr != nil || len(hash) != sha256.Size {
+			// 写入中断留下的临时文件等
+			return nil
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		if referenced[key] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		count++
+		size += uint64(info.Size())
+		return nil
+	})
+	return
+}
+
+// Flush 定义
+func (storage *FileTileStorage) Flush() error {
+	return nil
+}
+
+// Close 定义
+func (storage *FileTileStorage) Close() error {
+	return nil
+}
+
+// mbtilesTile 定义
+type mbtilesTile struct {
+	zoomLevel int
+	column    int64
+	row       int64
+	data      []byte
+	tileID    string
+}
+
+// MBTilesStorage 定义
+// 瓦片先缓存在内存中，每mbtilesBatchSize个瓦片在一个事务中写入。
+// 去重模式下使用map和images两张表，tiles为连接两者的视图，与普通MBTiles文件的读取方式相同。
+type MBTilesStorage struct {
+	db        *sql.DB
+	scheme    string
+	dedupe    bool
+	pending   []mbtilesTile
+	linkStats TileLinkStats
+	mu        sync.Mutex
+}
+
+// mbtilesDSN 定义
+// 任务目录由用户指定，可能包含?、#等字符，转义为file:URI后再附加参数。
+func mbtilesDSN(fileName string, query string) string {
+	dsn := url.URL{Scheme: "file", Opaque: (&url.URL{Path: fileName}).EscapedPath(), RawQuery: query}
+	return dsn.String()
+}
+
+// OpenMBTilesStorage 定义
+func OpenMBTilesStorage(fileName string, metadata *TileStorageMetadata) (storage *MBTilesStorage, err error) {
+	db, err := sql.Open("sqlite3", mbtilesDSN(fileName, ""))
+	if err != nil {
+		return
+	}
+	// 已有文件沿用原来的表结构，新建文件才按metadata.Dedupe选择
+	var tilesType string
+	err = db.QueryRow("SELECT type FROM sqlite_master WHERE name = 'tiles'").Scan(&tilesType)
+	if err != nil && err != sql.ErrNoRows {
+		db.Close()
+		return
+	}
+	dedupe := tilesType == "view" || (tilesType == "" && metadata.Dedupe)
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT)",
+	}
+	if dedupe {
+		statements = append(statements,
+			"CREATE TABLE IF NOT EXISTS map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS map_index ON map (zoom_level, tile_column, tile_row)",
+			"CREATE TABLE IF NOT EXISTS images (tile_id TEXT PRIMARY KEY, tile_data BLOB)",
+			"CREATE VIEW IF NOT EXISTS tiles AS SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row, images.tile_data AS tile_data FROM map JOIN images ON images.tile_id = map.tile_id",
+		)
+	} else {
+		statements = append(statements,
+			"CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row)",
+		)
+	}
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	values := map[string]string{
+		"name":    metadata.Name,
+		"type":    "baselayer",
+		"version": "1.0",
+		"format":  metadata.Format,
+		"minzoom": strconv.Itoa(metadata.MinZoomLevel),
+		"maxzoom": strconv.Itoa(metadata.MaxZoomLevel),
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", metadata.Bounds[0], metadata.Bounds[1], metadata.Bounds[2], metadata.Bounds[3]),
+		"center":  fmt.Sprintf("%f,%f,%d", (metadata.Bounds[0]+metadata.Bounds[2])/2, (metadata.Bounds[1]+metadata.Bounds[3])/2, metadata.MinZoomLevel),
+		// 非标准字段，记录瓦片编号方案，百度瓦片的编号不是标准的TMS编号
+		"scheme": metadata.Scheme,
+	}
+	for name, value := range values {
+		if _, err = db.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	storage = new(MBTilesStorage)
+	storage.db = db
+	storage.scheme = metadata.Scheme
+	storage.dedupe = dedupe
+	storage.pending = make([]mbtilesTile, 0, mbtilesBatchSize)
+	return
+}
+
+// Dedupe 定义
+func (storage *MBTilesStorage) Dedupe() bool {
+	return storage.dedupe
+}
+
+// tileRow 定义
+// MBTiles使用TMS的行号，XYZ方案需要翻转；百度方案y轴本身向北增长，直接保存。
+func (storage *MBTilesStorage) tileRow(mapProperties *MapProperties) int64 {
+	if storage.scheme == TileSchemeXYZ {
+		return int64(math.Pow(2, float64(mapProperties.zoomLevel))) - 1 - mapProperties.y
+	}
+	return mapProperties.y
+}
+
+// WriteTile 定义
+func (storage *MBTilesStorage) WriteTile(mapProperties *MapProperties, data []byte) error {
+	if storage.dedupe {
+		return storage.LinkTile(mapProperties, data, sha256.Sum256(data))
+	}
+	return storage.appendTile(mbtilesTile{mapProperties.zoomLevel, mapProperties.x, storage.tileRow(mapProperties), data, ""})
+}
+
+// LinkTile 定义
+// 不是去重模式的文件按普通方式保存。
+func (storage *MBTilesStorage) LinkTile(mapProperties *MapProperties, data []byte, hash [sha256.Size]byte) error {
+	if !storage.dedupe {
+		err := storage.appendTile(mbtilesTile{mapProperties.zoomLevel, mapProperties.x, storage.tileRow(mapProperties), data, ""})
+		if err == nil {
+			storage.linkStats.add(len(data), false, true)
+		}
+		return err
+	}
+	return storage.appendTile(mbtilesTile{mapProperties.zoomLevel, mapProperties.x, storage.tileRow(mapProperties), data, hex.EncodeToString(hash[:])})
+}
+
+// LinkStats 定义
+// 去重模式下在写入数据库时统计。
+func (storage *MBTilesStorage) LinkStats() TileLinkStats {
+	return storage.linkStats.snapshot()
+}
+
+// RemoveOrphans 定义
+// 删除images表中map表没有引用的内容，不是去重模式的文件不做任何事。
+func (storage *MBTilesStorage) RemoveOrphans(referenced map[[sha256.Size]byte]bool) (count int, size uint64, err error) {
+	if !storage.dedupe {
+		return
+	}
+	if err = storage.Flush(); err != nil {
+		return
+	}
+	var orphanSize sql.NullInt64
+	err = storage.db.QueryRow("SELECT COUNT(*), SUM(LENGTH(tile_data)) FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)").Scan(&count, &orphanSize)
+	if err != nil || count == 0 {
+		return
+	}
+	if _, err = storage.db.Exec("DELETE FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)"); err != nil {
+		return 0, 0, err
+	}
+	size = uint64(orphanSize.Int64)
+	return
+}
+
+// appendTile 定义
+func (storage *MBTilesStorage) appendTile(tile mbtilesTile) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.pending = append(storage.pending, tile)
+	if len(storage.pending) >= mbtilesBatchSize {
+		return storage.flush()
+	}
+	return nil
+}
+
+// ReadTile 定义
+func (storage *MBTilesStorage) ReadTile(mapProperties *MapProperties) (data []byte, err error) {
+	row := storage.tileRow(mapProperties)
+	storage.mu.Lock()
+	for _, tile := range storage.pending {
+		if tile.zoomLevel == mapProperties.zoomLevel && tile.column == mapProperties.x && tile.row == row {
+			storage.mu.Unlock()
+			return tile.data, nil
+		}
+	}
+	storage.mu.Unlock()
+
+	err = storage.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", mapProperties.zoomLevel, mapProperties.x, row).Scan(&data)
+	if err == sql.ErrNoRows {
+		err = os.ErrNotExist
+	}
+	return
+}
+
+// flush 定义
+func (storage *MBTilesStorage) flush() (err error) {
+	if len(storage.pending) == 0 {
+		return
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return
+	}
+	if storage.dedupe {
+		err = storage.flushDedupe(tx)
+	} else {
+		err = storage.flushTiles(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err == nil {
+		storage.pending = make([]mbtilesTile, 0, mbtilesBatchSize)
+	}
+	return
+}
+
+// flushTiles 定义
+func (storage *MBTilesStorage) flushTiles(tx *sql.Tx) error {
+	statement, err := tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	for _, tile := range storage.pending {
+		if _, err = statement.Exec(tile.zoomLevel, tile.column, tile.row, tile.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushDedupe 定义
+func (storage *MBTilesStorage) flushDedupe(tx *sql.Tx) error {
+	imageStatement, err := tx.Prepare("INSERT OR IGNORE INTO images (tile_id, tile_data) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer imageStatement.Close()
+	mapStatement, err := tx.Prepare("INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer mapStatement.Close()
+	shared := make([]bool, len(storage.pending))
+	for i, tile := range storage.pending {
+		result, err := imageStatement.Exec(tile.tileID, tile.data)
+		if err != nil {
+			return err
+		}
+		// images中已有相同内容时不插入
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			shared[i] = true
+		}
+		if _, err = mapStatement.Exec(tile.zoomLevel, tile.column, tile.row, tile.tileID); err != nil {
+			return err
+		}
+	}
+	for i, tile := range storage.pending {
+		storage.linkStats.add(len(tile.data), shared[i], false)
+	}
+	return nil
+}
+
+// Flush 定义
+func (storage *MBTilesStorage) Flush() error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.flush()
+}
+
+// Close 定义
+func (storage *MBTilesStorage) Close() error {
+	err := storage.Flush()
+	closeErr := storage.db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// polygonBounds 定义
+// 返回多边形转换到WGS84后的外接矩形：左、下、右、上。
+func polygonBounds(polygons []PolygonStruct, datum string) (bounds [4]float64) {
+	bounds = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, polygon := range polygons {
+		for _, ring := range polygon.rings {
+			for _, point := range ring {
+				lng, lat := ConvertDatum(point[0], point[1], datum, DatumWGS84)
+				bounds[0] = math.Min(bounds[0], lng)
+				bounds[1] = math.Min(bounds[1], lat)
+				bounds[2] = math.Max(bounds[2], lng)
+				bounds[3] = math.Max(bounds[3], lat)
+			}
+		}
+	}
+	if math.IsInf(bounds[0], 1) {
+		bounds = [4]float64{-180, -85.0511, 180, 85.0511}
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"sync"
+)
+
+// maxPlaceholderCandidates 检测占位瓦片时最多记录的不同内容数，超过时丢弃只出现过一次的内容
+const maxPlaceholderCandidates = 100000
+
+// 空白和占位瓦片的处理方式定义
+const (
+	EmptyTileStore  = "store"
+	EmptyTileSkip   = "skip"
+	EmptyTileDedupe = "dedupe"
+	EmptyTileError  = "error"
+)
+
+// 瓦片内容分类定义
+const (
+	TileKindNormal = iota
+	// TileKindBlank 整张瓦片只有一种颜色，如海洋或透明的标注层
+	TileKindBlank
+	// TileKindPlaceholder 与配置中的“无数据”占位瓦片内容相同
+	TileKindPlaceholder
+)
+
+// TileValidationConfigStruct 定义
+type TileValidationConfigStruct struct {
+	// EmptyTilePolicy 任务未指定时空白和占位瓦片的处理方式
+	EmptyTilePolicy string
+	// PlaceholderHashes 已知占位瓦片的SHA-256
+	PlaceholderHashes []string
+	// PlaceholderThreshold 不是纯色、内容完全相同的瓦片出现在这么多个位置后视为占位瓦片，0为不检测
+	PlaceholderThreshold int
+}
+
+// TileValidator 定义
+// 除配置中已知的占位瓦片外，按内容出现的次数检测未知的占位瓦片：
+// “无数据”图片在大量位置重复出现，正常的地图瓦片几乎不会完全相同。
+type TileValidator struct {
+	placeholders map[[sha256.Size]byte]bool
+	threshold    int
+	candidates   map[[sha256.Size]byte]int
+	mu           sync.Mutex
+}
+
+// NewTileValidator 定义
+func NewTileValidator(hashes []string, threshold int) (*TileValidator, error) {
+	if threshold < 0 {
+		return nil, fmt.Errorf("invalid placeholder threshold %d", threshold)
+	}
+	validator := new(TileValidator)
+	validator.threshold = threshold
+	validator.candidates = make(map[[sha256.Size]byte]int)
+	validator.placeholders = make(map[[sha256.Size]byte]bool)
+	for _, value := range hashes {
+		hash, err := hex.DecodeString(value)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid placeholder hash %s", value)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		validator.placeholders[key] = true
+	}
+	return validator, nil
+}
+
+// Validate 定义
+// 解码瓦片图片，无法解码时返回invalid_tile错误，否则返回瓦片的分类。
+func (validator *TileValidator) Validate(data []byte, hash [sha256.Size]byte) (int, error) {
+	validator.mu.Lock()
+	placeholder := validator.placeholders[hash]
+	validator.mu.Unlock()
+	if placeholder {
+		return TileKindPlaceholder, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return TileKindNormal, &TileError{Reason: TileErrorInvalidTile, Err: err}
+	}
+	if isUniformImage(img) {
+		return TileKindBlank, nil
+	}
+	if validator.repeated(hash) {
+		return TileKindPlaceholder, nil
+	}
+	return TileKindNormal, nil
+}
+
+// repeated 定义
+// 记录内容出现的次数，达到阈值时加入占位瓦片。
+func (validator *TileValidator) repeated(hash [sha256.Size]byte) bool {
+	if validator.threshold == 0 {
+		return false
+	}
+	validator.mu.Lock()
+	defer validator.mu.Unlock()
+	if len(validator.candidates) >= maxPlaceholderCandidates {
+		for key, count := range validator.candidates {
+			if count <= 1 {
+				delete(validator.candidates, key)
+			}
+		}
+	}
+	validator.candidates[hash]++
+	if validator.candidates[hash] < validator.threshold {
+		return false
+	}
+	delete(validator.candidates, hash)
+	validator.placeholders[hash] = true
+	log.Printf("检测到占位瓦片%s，可加入配置的PlaceholderHashes\n", hex.EncodeToString(hash[:]))
+	return true
+}
+
+// isUniformImage 定义
+func isUniformImage(img image.Image) bool {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return true
+	}
+	r0, g0, b0, a0 := img.At(bounds.Min.X, bounds.Min.Y).RGBA()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 && a0 == 0 {
+				continue
+			}
+			if r != r0 || g != g0 || b != b0 || a != a0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validEmptyTilePolicy 定义
+func validEmptyTilePolicy(policy string) bool {
+	switch policy {
+	case EmptyTileStore, EmptyTileSkip, EmptyTileDedupe, EmptyTileError:
+		return true
+	}
+	return false
+}
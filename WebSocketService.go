@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,8 +22,14 @@ type WebSocketService struct {
 	addr              *string
 	staticFilesHander http.Handler
 	homeTempl         *template.Template
-	submitCallback    SubmitCallback
+	requestCallback   RequestCallback
+	estimateCallback  QueryCallback
+	tileServer        *TileServer
+	jobAPI            *JobAPI
+	metrics           *Metrics
 	h                 hub
+	events            *EventLog
+	seq               uint64
 }
 
 // NewWebSocketService 定义
@@ -25,12 +37,18 @@ func NewWebSocketService(pathName string, pageName string, port int) *WebSocketS
 	webSocketService := new(WebSocketService)
 
 	webSocketService.h = hub{
-		message:     make(chan []byte),
-		register:    make(chan *connection),
-		unregister:  make(chan *connection),
-		connections: make(map[*connection]bool),
+		message:        make(chan inboundMessage),
+		broadcast:      make(chan *JobEvent),
+		reply:          make(chan outboundMessage),
+		subscribe:      make(chan subscription),
+		register:       make(chan *connection),
+		unregister:     make(chan *connection),
+		connections:    make(map[*connection]bool),
+		websocketCount: new(int64),
+		streamCount:    new(int64),
 	}
 
+	webSocketService.events = NewEventLog()
 	webSocketService.homeTempl = template.Must(template.ParseFiles(pathName + "/" + pageName))
 	webSocketService.staticFilesHander = http.FileServer(http.Dir(pathName + "/static"))
 	portStr := fmt.Sprintf(":%d", port)
@@ -38,8 +56,8 @@ func NewWebSocketService(pathName string, pageName string, port int) *WebSocketS
 	return webSocketService
 }
 
-// SubmitCallback 定义
-type SubmitCallback func(message []byte)
+// QueryCallback 定义
+type QueryCallback func(message []byte) (interface{}, error)
 
 const (
 	// Time allowed to write a message to the peer.
@@ -51,8 +69,9 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 5120
+	// Maximum message size allowed from peer. Uploaded GeoJSON areas are sent
+	// inside the submit message.
+	maxMessageSize = 8 << 20
 )
 
 var upgrader = websocket.Upgrader{
@@ -61,12 +80,32 @@ var upgrader = websocket.Upgrader{
 }
 
 // connection is an middleman between the websocket connection and the hub.
+// Server-Sent Events streams use the same type without a websocket.
 type connection struct {
-	// The websocket connection.
+	// The websocket connection, nil for an event stream.
 	ws *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outboundMessage
+
+	// Jobs whose events are sent to this connection. Only accessed by the hub.
+	jobs map[int]bool
+
+	// Events of the subscribed jobs after this seq are replayed on register.
+	// Zero replays the recent events.
+	resumeSeq uint64
+}
+
+// newConnection 定义
+// 重新连接的页面通过jobs参数恢复之前订阅的任务。
+func newConnection(ws *websocket.Conn, r *http.Request, resumeSeq uint64) *connection {
+	c := &connection{send: make(chan outboundMessage, 256), ws: ws, jobs: make(map[int]bool), resumeSeq: resumeSeq}
+	for _, value := range strings.Split(r.URL.Query().Get("jobs"), ",") {
+		if jobID, err := strconv.Atoi(value); err == nil && jobID > 0 {
+			c.jobs[jobID] = true
+		}
+	}
+	return c
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -87,7 +126,7 @@ func (c *connection) readPump(h hub) {
 			continue
 			// break
 		}
-		h.message <- message
+		h.message <- inboundMessage{c, message}
 	}
 }
 
@@ -111,8 +150,10 @@ func (c *connection) writePump() {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
-				return
+			for _, event := range message.events() {
+				if err := c.write(websocket.TextMessage, event.data); err != nil {
+					return
+				}
 			}
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
@@ -129,12 +170,46 @@ func (service *WebSocketService) serveWs(w http.ResponseWriter, r *http.Request)
 		log.Println(err)
 		return
 	}
-	c := &connection{send: make(chan []byte, 256), ws: ws}
+	c := newConnection(ws, r, 0)
 	service.h.register <- c
 	go c.writePump()
 	c.readPump(service.h)
 }
 
+// inboundMessage is a message read from a connection, kept together with the
+// connection so that replies go back to the sender only.
+type inboundMessage struct {
+	c    *connection
+	data []byte
+}
+
+// outboundMessage is a reply for a single connection, or an event for the
+// connections subscribed to its job. Replayed events are queued as a single
+// message, so a long replay takes one slot of the send buffer and stays in
+// order with the events sent after it.
+type outboundMessage struct {
+	c        *connection
+	envelope *Envelope
+	data     []byte
+	replay   []*LoggedEvent
+}
+
+// events 定义
+// 返回要写出的事件，补发的事件由连接自己的goroutine逐条写出。
+func (m outboundMessage) events() []*LoggedEvent {
+	if m.replay != nil {
+		return m.replay
+	}
+	return []*LoggedEvent{{Envelope: m.envelope, data: m.data}}
+}
+
+// subscription adds or removes a job from a connection's subscriptions.
+type subscription struct {
+	c     *connection
+	jobID int
+	watch bool
+}
+
 // hub maintains the set of active connections and broadcasts messages to the
 // connections.
 type hub struct {
@@ -142,13 +217,27 @@ type hub struct {
 	connections map[*connection]bool
 
 	// Inbound messages from the connections.
-	message chan []byte
+	message chan inboundMessage
+
+	// Outbound events, numbered in the order they are received. Events
+	// without a job go to all connections.
+	broadcast chan *JobEvent
+
+	// Outbound replies for a single connection.
+	reply chan outboundMessage
+
+	// Subscription changes from the connections.
+	subscribe chan subscription
 
 	// Register requests from the connections.
 	register chan *connection
 
 	// Unregister requests from connections.
 	unregister chan *connection
+
+	// Number of registered websocket and event stream connections, read by
+	// the metrics endpoint.
+	websocketCount, streamCount *int64
 }
 
 // run 定义
@@ -157,19 +246,98 @@ func (h *hub) run(service *WebSocketService) {
 		select {
 		case c := <-h.register:
 			h.connections[c] = true
+			atomic.AddInt64(h.connectionCount(c), 1)
+			for jobID := range c.jobs {
+				h.replay(c, service.events, jobID, c.resumeSeq)
+			}
 		case c := <-h.unregister:
 			if _, ok := h.connections[c]; ok {
-				delete(h.connections, c)
-				close(c.send)
+				h.remove(c)
 			}
 		case m := <-h.message:
-			if service.submitCallback != nil {
-				service.submitCallback(m)
+			service.handleMessage(m)
+		case event := <-h.broadcast:
+			// seq在hub中按接收顺序分配并立即记录，日志中的事件按seq排列，
+			// 按Last-Event-ID补发时不会跳过或重复事件
+			envelope, data, err := service.encode(event, 0)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			service.events.Append(envelope, data)
+			m := outboundMessage{envelope: envelope, data: data}
+			for c := range h.connections {
+				if m.envelope.JobID == 0 || c.jobs[m.envelope.JobID] {
+					h.send(c, m)
+				}
+			}
+		case s := <-h.subscribe:
+			if s.watch {
+				if !s.c.jobs[s.jobID] && h.connections[s.c] {
+					h.replay(s.c, service.events, s.jobID, 0)
+				}
+				s.c.jobs[s.jobID] = true
+			} else {
+				delete(s.c.jobs, s.jobID)
+			}
+		case m := <-h.reply:
+			if h.connections[m.c] {
+				h.send(m.c, m)
 			}
 		}
 	}
 }
 
+// replay 定义
+// 把任务的当前进度和最近的事件补发给新订阅的连接，
+// seq不为0时补发该seq之后的全部事件。补发的事件只占用一个发送缓冲，
+// 订阅多个任务或按Last-Event-ID补发上千条事件的连接不会因补发而被视为已断开。
+func (h *hub) replay(c *connection, events *EventLog, jobID int, seq uint64) {
+	replayEvents := events.Recent(jobID)
+	if seq > 0 {
+		replayEvents = events.Since(jobID, seq)
+	}
+	if len(replayEvents) == 0 || !h.connections[c] {
+		return
+	}
+	h.send(c, outboundMessage{c: c, replay: replayEvents})
+}
+
+// send 定义
+// 发送缓冲已满的连接视为已断开。
+func (h *hub) send(c *connection, message outboundMessage) {
+	select {
+	case c.send <- message:
+	default:
+		h.remove(c)
+	}
+}
+
+// remove 定义
+func (h *hub) remove(c *connection) {
+	delete(h.connections, c)
+	close(c.send)
+	atomic.AddInt64(h.connectionCount(c), -1)
+}
+
+// connectionCount 定义
+func (h *hub) connectionCount(c *connection) *int64 {
+	if c.ws == nil {
+		return h.streamCount
+	}
+	return h.websocketCount
+}
+
+// registerMetrics 定义
+func (service *WebSocketService) registerMetrics() {
+	service.metrics.GaugeFunc("getmaps_websocket_connections", "WebSocket连接数", func() float64 {
+		return float64(atomic.LoadInt64(service.h.websocketCount))
+	})
+	service.metrics.GaugeFunc("getmaps_event_stream_connections", "/events事件流连接数", func() float64 {
+		return float64(atomic.LoadInt64(service.h.streamCount))
+	})
+}
+
 // serveHome 定义
 func (service *WebSocketService) serveHome(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
@@ -184,16 +352,101 @@ func (service *WebSocketService) serveHome(w http.ResponseWriter, r *http.Reques
 	service.homeTempl.Execute(w, r.Host)
 }
 
-// BroadcastMessage 定义
-func (service *WebSocketService) BroadcastMessage(message string) {
-	for c := range service.h.connections {
-		select {
-		case c.send <- []byte(message):
-		default:
-			close(c.send)
-			delete(service.h.connections, c)
+// serveEstimate 定义
+func (service *WebSocketService) serveEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if service.estimateCallback == nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	result, err := service.estimateCallback(message)
+	if err != nil {
+		writeJSON(w, 400, map[string]string{"Error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, result)
+}
+
+// writeJSON 定义
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+// handleMessage 定义
+// 格式错误的消息只回复给发送的连接。请求在单独的goroutine中处理，
+// 提交任务时读取区域文件等操作不会阻塞hub。
+func (service *WebSocketService) handleMessage(m inboundMessage) {
+	request, err := ParseEnvelope(m.data)
+	if err != nil {
+		var replyTo uint64
+		if request != nil {
+			replyTo = request.Seq
 		}
+		envelope, message, err := service.encode(&JobEvent{MessageTypeError, 0, ErrorPayload{EventText{err.Error()}, err.Error()}}, replyTo)
+		if err == nil && service.h.connections[m.c] {
+			service.h.send(m.c, outboundMessage{c: m.c, envelope: envelope, data: message})
+		}
+		return
 	}
+	if service.requestCallback == nil {
+		return
+	}
+	go service.requestCallback(request, &connectionRequester{service, m.c, request.Seq})
+}
+
+// connectionRequester 定义
+// 把回复和订阅通过hub转发给发送请求的连接，连接已断开时丢弃。
+type connectionRequester struct {
+	service *WebSocketService
+	c       *connection
+	seq     uint64
+}
+
+// Reply 定义
+func (requester *connectionRequester) Reply(event *JobEvent) {
+	envelope, message, err := requester.service.encode(event, requester.seq)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	requester.service.h.reply <- outboundMessage{c: requester.c, envelope: envelope, data: message}
+}
+
+// Watch 定义
+func (requester *connectionRequester) Watch(jobID int) {
+	requester.service.h.subscribe <- subscription{requester.c, jobID, true}
+}
+
+// Unwatch 定义
+func (requester *connectionRequester) Unwatch(jobID int) {
+	requester.service.h.subscribe <- subscription{requester.c, jobID, false}
+}
+
+// encode 定义
+func (service *WebSocketService) encode(event *JobEvent, replyTo uint64) (*Envelope, []byte, error) {
+	envelope, err := NewEnvelope(event, atomic.AddUint64(&service.seq, 1), replyTo)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(envelope)
+	return envelope, data, err
+}
+
+// PublishEvent 定义
+// 任务事件只发送给订阅了该任务的连接，其他事件发送给所有连接。
+// 由hub按调用顺序编号，调用方应在产生事件的goroutine中同步调用，不要另起goroutine。
+func (service *WebSocketService) PublishEvent(event *JobEvent) {
+	service.h.broadcast <- event
 }
 
 // Start 定义
@@ -202,6 +455,22 @@ func (service *WebSocketService) Start() {
 	http.Handle("/static/", http.StripPrefix("/static/", service.staticFilesHander))
 	http.HandleFunc("/", service.serveHome)
 	http.HandleFunc("/ws", service.serveWs)
+	http.HandleFunc("/estimate", service.serveEstimate)
+	http.HandleFunc("/events", service.serveEvents)
+	http.HandleFunc("/api/messages", service.serveMessages)
+	if service.tileServer != nil {
+		http.HandleFunc("/tiles/", service.tileServer.ServeTile)
+		http.HandleFunc("/preview/", service.tileServer.ServePreview)
+	}
+	if service.metrics != nil {
+		service.registerMetrics()
+		http.Handle("/metrics", service.metrics)
+	}
+	if service.jobAPI != nil {
+		http.HandleFunc("/api/jobs", service.jobAPI.ServeJobs)
+		http.HandleFunc("/api/jobs/", service.jobAPI.ServeJobs)
+		http.HandleFunc("/api/provinces", service.jobAPI.ServeProvinces)
+	}
 	err := http.ListenAndServe(*service.addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)